@@ -1 +0,0 @@
-RUN iptables -A INPUT -p tcp --dport 55324 -j DROP
\ No newline at end of file
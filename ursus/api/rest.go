@@ -15,10 +15,12 @@ type Rest struct {
 	public
 }
 
-func NewRest(store store.ProxyStore) *Rest {
+func NewRest(store store.ProxyStore, walkers WalkerLister, jobs JobQueue) *Rest {
 	return &Rest{
 		public: public{
-			store: store,
+			store:   store,
+			walkers: walkers,
+			jobs:    jobs,
 		},
 	}
 }
@@ -41,6 +43,9 @@ func (s *Rest) routes() chi.Router {
 			r.Use(middleware.Timeout(5 * time.Second))
 			r.Use(middleware.NoCache)
 			r.Get("/list", s.public.getProxyList)
+			r.Get("/walkers", s.public.getWalkers)
+			r.Get("/jobs", s.public.getJobs)
+			r.Post("/jobs", s.public.submitJob)
 		})
 	})
 
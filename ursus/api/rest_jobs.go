@@ -0,0 +1,46 @@
+package api
+
+import (
+	"github.com/go-chi/render"
+	"net/http"
+	"ursus/jobs"
+)
+
+type JobQueue interface {
+	Submit(targets []string, ports string, rate uint32) (*jobs.Job, error)
+	Jobs() []jobs.Job
+}
+
+type JobRequest struct {
+	Targets []string `json:"targets"`
+	Ports   string   `json:"ports"`
+	Rate    uint32   `json:"rate"`
+}
+
+type JobList struct {
+	Jobs []jobs.Job `json:"jobs"`
+}
+
+const defaultRate uint32 = 100
+
+func (s *public) getJobs(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, JobList{s.jobs.Jobs()})
+}
+
+func (s *public) submitJob(w http.ResponseWriter, r *http.Request) {
+	req := JobRequest{}
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		SendErrorJSON(w, r, http.StatusBadRequest, err, "error decoding the job")
+		return
+	}
+	if req.Rate == 0 {
+		req.Rate = defaultRate
+	}
+	job, err := s.jobs.Submit(req.Targets, req.Ports, req.Rate)
+	if err != nil {
+		SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid job")
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, job)
+}
@@ -4,17 +4,28 @@ import (
 	"github.com/go-chi/render"
 	"net/http"
 	"strconv"
+	"ursus/control"
 	"ursus/store"
 )
 
+type WalkerLister interface {
+	Walkers() []control.Walker
+}
+
 type public struct {
-	store store.ProxyStore
+	store   store.ProxyStore
+	walkers WalkerLister
+	jobs    JobQueue
 }
 
 type ProxyList struct {
 	Proxies []store.Proxy `json:"proxies"`
 }
 
+type WalkerList struct {
+	Walkers []control.Walker `json:"walkers"`
+}
+
 const defaultPageSize int64 = 10
 
 func (s *public) getProxyList(w http.ResponseWriter, r *http.Request) {
@@ -31,3 +42,7 @@ func (s *public) getProxyList(w http.ResponseWriter, r *http.Request) {
 
 	render.JSON(w, r, ProxyList{result})
 }
+
+func (s *public) getWalkers(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, WalkerList{s.walkers.Walkers()})
+}
@@ -0,0 +1,96 @@
+package control
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+)
+
+// Walkers authenticate right after connecting:
+//
+//	walker -> hello (walker id metadata)
+//	ursus  -> challenge (random nonce)
+//	walker -> auth (HMAC-SHA256 of nonce | walker id with the shared key)
+//	ursus  -> auth ok, or the connection is closed
+//
+// Without a configured key the hello is answered with auth ok right away.
+const (
+	frameHello     = 0x4
+	frameChallenge = 0x5
+	frameAuth      = 0x6
+	frameAuthOk    = 0x7
+)
+
+const nonceLen = 32
+
+var errUnauthenticated = errors.New("walker is not authenticated")
+
+func mac(key, nonce []byte, walkerID string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(nonce)
+	h.Write([]byte(walkerID))
+	return h.Sum(nil)
+}
+
+// authenticate performs the handshake if the walker starts with hello and returns the walker id.
+// Walkers that don't say hello are only accepted when no key is configured.
+func (s *srv) authenticate(conn net.Conn, r *bufio.Reader) (string, error) {
+	header, err := r.Peek(headerLen)
+	if err != nil {
+		return "", err
+	}
+	if header[2] != frameHello {
+		if s.key != nil {
+			s.reject(conn, "", "no hello received")
+			return "", errUnauthenticated
+		}
+		return "", nil
+	}
+	f, err := readFrame(r)
+	if err != nil {
+		return "", err
+	}
+	d := &decoder{buf: f.payload}
+	walkerID := string(d.attrs()[metaWalkerID])
+	if d.err != nil {
+		return "", errors.Wrap(d.err, "malformed hello")
+	}
+	if s.key == nil {
+		return walkerID, writeFrame(conn, frameAuthOk, nil)
+	}
+
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "error generating nonce")
+	}
+	setDeadline(conn)
+	if err := writeFrame(conn, frameChallenge, nonce); err != nil {
+		return "", err
+	}
+	setDeadline(conn)
+	f, err = readFrame(r)
+	if err != nil {
+		return "", err
+	}
+	if f.kind != frameAuth {
+		s.reject(conn, walkerID, "no challenge response received")
+		return "", errUnauthenticated
+	}
+	if !hmac.Equal(f.payload, mac(s.key, nonce, walkerID)) {
+		s.reject(conn, walkerID, "invalid challenge response")
+		return "", errUnauthenticated
+	}
+	setDeadline(conn)
+	return walkerID, writeFrame(conn, frameAuthOk, nil)
+}
+
+func (s *srv) reject(conn net.Conn, walkerID string, reason string) {
+	if walkerID == "" {
+		walkerID = "unknown"
+	}
+	log.Printf("Rejected walker %q from %s: %s", walkerID, conn.RemoteAddr(), reason)
+}
@@ -0,0 +1,117 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+var goldenV2Hello = []byte{
+	0x55, 0x02, 0x04, // magic, version, hello
+	0x00, 0x00, 0x00, 0x07, // payload length
+	0x01,                            // metadata count
+	0x02, 0x00, 0x03, 'w', '-', '1', // walker id
+}
+
+var testKey = []byte("secret")
+
+// handshake sends hello and answers the challenge with the given key
+func handshake(t *testing.T, conn net.Conn, key []byte) {
+	t.Helper()
+	if _, err := conn.Write(goldenV2Hello); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.kind != frameChallenge || len(f.payload) != nonceLen {
+		t.Fatalf("challenge expected, got %v", f)
+	}
+	if err := writeFrame(conn, frameAuth, mac(key, f.payload, "w-1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closed(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestSrv_authenticate(t *testing.T) {
+	st := &memStore{}
+	conn, _ := session(t, &srv{store: st, key: testKey, registry: NewRegistry()})
+
+	handshake(t, conn, testKey)
+	f, err := readFrame(conn)
+	if err != nil || f.kind != frameAuthOk {
+		t.Fatalf("auth ok expected, got %v %v", f, err)
+	}
+	// batch claims to be from another walker
+	batch := append([]byte(nil), goldenV2Batch...)
+	copy(batch[bytes.Index(batch, []byte("w-1")):], "w-2")
+	if _, err := conn.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, goldenV2BatchAck)
+	proxies, _ := st.FindAll(context.Background(), 0, 0)
+	for _, p := range proxies {
+		if p.Walker != "w-1" {
+			t.Errorf("proxy is attributed to %s instead of the authenticated walker", p.Walker)
+		}
+	}
+}
+
+func TestSrv_authenticate_rejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		session func(t *testing.T, conn net.Conn)
+	}{
+		{"wrong key", func(t *testing.T, conn net.Conn) {
+			handshake(t, conn, []byte("guess"))
+		}},
+		{"no hello", func(t *testing.T, conn net.Conn) {
+			_, _ = conn.Write(goldenV2Batch)
+		}},
+		{"v1", func(t *testing.T, conn net.Conn) {
+			_, _ = conn.Write(goldenV1Proxy)
+		}},
+		{"no challenge response", func(t *testing.T, conn net.Conn) {
+			_, _ = conn.Write(goldenV2Hello)
+			if _, err := readFrame(conn); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = conn.Write(goldenV2Batch)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &memStore{}
+			conn, done := session(t, &srv{store: st, key: testKey, registry: NewRegistry()})
+			tt.session(t, conn)
+			closed(t, done)
+			if proxies, _ := st.FindAll(context.Background(), 0, 0); len(proxies) != 0 {
+				t.Errorf("proxies from an unauthenticated walker are saved: %v", proxies)
+			}
+		})
+	}
+}
+
+func TestSrv_authenticate_noKey(t *testing.T) {
+	st := &memStore{}
+	conn, _ := session(t, &srv{store: st, registry: NewRegistry()})
+
+	if _, err := conn.Write(goldenV2Hello); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readFrame(conn)
+	if err != nil || f.kind != frameAuthOk {
+		t.Fatalf("auth ok expected, got %v %v", f, err)
+	}
+}
@@ -0,0 +1,356 @@
+package control
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"ursus/jobs"
+	"ursus/store"
+)
+
+// v1 messages are a single type byte optionally followed by a fixed size body:
+//
+//	heartbeat: 0x0
+//	proxy:     0x2 | proto (1) | ipv4 (4) | port (2, big endian)
+//
+// Every message is acknowledged with a single 0x1 byte.
+const v1ProxyLen = 7
+
+// v2 frames are length-prefixed:
+//
+//	magic (1) | version (1) | type (1) | payload length (4, big endian) | payload
+//
+// The magic byte never starts a v1 message, so the version of the walker is detected by the first byte it sends.
+const (
+	frameMagic   = 0x55
+	frameVersion = 0x02
+	headerLen    = 7
+	maxPayload   = 1 << 20
+)
+
+const (
+	frameHeartbeat    = 0x0
+	frameHeartbeatAck = 0x1
+	frameBatch        = 0x2
+	frameBatchAck     = 0x3
+)
+
+// Walkers in the worker mode ask for shards of scan jobs:
+//
+//	walker -> shard request
+//	ursus  -> shard (scan id, shard id, targets, ports and rate metadata), empty if there is no work
+//	walker -> shard done (shard id metadata) after scanning it
+//	ursus  -> shard done ack
+const (
+	frameShardRequest = 0x8
+	frameShard        = 0x9
+	frameShardDone    = 0xa
+	frameShardDoneAck = 0xb
+)
+
+// batch and heartbeat metadata keys
+const (
+	metaScanID   = 0x1
+	metaWalkerID = 0x2
+	metaTargets  = 0x3
+	metaPorts    = 0x4
+	metaRate     = 0x5
+	metaShardID  = 0x6
+)
+
+// proxy attribute keys, unknown attributes are ignored
+const (
+	attrServer   = 0x1
+	attrVia      = 0x2
+	attrAuth     = 0x3
+	attrVersion  = 0x4
+	attrResponse = 0x5
+	attrRTT      = 0x6
+)
+
+// metaAttributes are the attributes kept in the proxy metadata by their keys
+var metaAttributes = map[byte]string{
+	attrVia: "via",
+}
+
+var protocols = map[byte]string{
+	0x1: "socks5",
+	0x2: "socks4",
+	0x3: "socks4a",
+	0x4: "http",
+}
+
+type frame struct {
+	kind    byte
+	payload []byte
+}
+
+// batch is a set of proxies reported by a walker with a single frame
+//
+//	id (4) | metadata count (1) | metadata | proxies count (2) | proxies
+//
+// metadata and proxy attributes are encoded as key (1) | length (2) | value.
+// A proxy is
+//
+//	proto (1) | address length (1) | address (4 or 16) | port (2) | attributes count (1) | attributes
+type batch struct {
+	id       uint32
+	scanID   string
+	walkerID string
+	proxies  []store.Proxy
+}
+
+func (b *batch) setWalker(id string) {
+	b.walkerID = id
+	for i := range b.proxies {
+		b.proxies[i].Walker = id
+	}
+}
+
+func readV1Proxy(r io.Reader) (*store.Proxy, error) {
+	buf := make([]byte, v1ProxyLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	proto, ok := protocols[buf[0]]
+	if !ok || proto != "socks5" {
+		return nil, errors.Errorf("unknown proxy protocol %#x", buf[0])
+	}
+	return &store.Proxy{
+		Addr:  net.IP(buf[1:5]),
+		Port:  binary.BigEndian.Uint16(buf[5:7]),
+		Proto: proto,
+	}, nil
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != frameMagic {
+		return nil, errors.Errorf("invalid frame magic %#x", header[0])
+	}
+	if header[1] != frameVersion {
+		return nil, errors.Errorf("unsupported protocol version %d", header[1])
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if size > maxPayload {
+		return nil, errors.Errorf("frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Wrap(err, "error reading frame payload")
+	}
+	return &frame{header[2], payload}, nil
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	buf := make([]byte, headerLen+len(payload))
+	buf[0] = frameMagic
+	buf[1] = frameVersion
+	buf[2] = kind
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(payload)))
+	copy(buf[headerLen:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func encodeBatchAck(id uint32, saved uint16) []byte {
+	buf := make([]byte, 6)
+	binary.BigEndian.PutUint32(buf, id)
+	binary.BigEndian.PutUint16(buf[4:], saved)
+	return buf
+}
+
+// decoder reads fields from a frame payload and remembers the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = errors.New("unexpected end of frame")
+		return nil
+	}
+	res := d.buf[:n]
+	d.buf = d.buf[n:]
+	return res
+}
+
+func (d *decoder) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// attrs reads a list of key-value attributes
+func (d *decoder) attrs() map[byte][]byte {
+	cnt := int(d.byte())
+	res := make(map[byte][]byte, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		k := d.byte()
+		res[k] = d.next(int(d.uint16()))
+	}
+	return res
+}
+
+// decodeHeartbeat returns the scan reported with the heartbeat, if any.
+// The heartbeat payload is optional metadata describing the current scan.
+func decodeHeartbeat(payload []byte) (*Scan, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	d := &decoder{buf: payload}
+	meta := d.attrs()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "malformed heartbeat")
+	}
+	return &Scan{
+		ID:      string(meta[metaScanID]),
+		Targets: string(meta[metaTargets]),
+		Ports:   string(meta[metaPorts]),
+		Rate:    string(meta[metaRate]),
+	}, nil
+}
+
+func encodeShard(shard *jobs.Shard) ([]byte, error) {
+	if shard == nil {
+		return nil, nil
+	}
+	return encodeAttrs(map[byte]string{
+		metaScanID:  shard.Job,
+		metaShardID: shard.ID,
+		metaTargets: strings.Join(shard.Targets, ","),
+		metaPorts:   shard.Ports,
+		metaRate:    strconv.FormatUint(uint64(shard.Rate), 10),
+	})
+}
+
+func decodeShardDone(payload []byte) (string, error) {
+	d := &decoder{buf: payload}
+	id := string(d.attrs()[metaShardID])
+	if d.err != nil {
+		return "", errors.Wrap(d.err, "malformed shard done")
+	}
+	if id == "" {
+		return "", errors.New("shard id is missing")
+	}
+	return id, nil
+}
+
+// encodeAttrs encodes non-empty attributes ordered by key, the values are limited to 64 KiB
+func encodeAttrs(attrs map[byte]string) ([]byte, error) {
+	keys := make([]int, 0, len(attrs))
+	for k, v := range attrs {
+		if v != "" {
+			keys = append(keys, int(k))
+		}
+	}
+	sort.Ints(keys)
+	buf := []byte{byte(len(keys))}
+	for _, k := range keys {
+		v := attrs[byte(k)]
+		if len(v) > 0xFFFF {
+			return nil, errors.Errorf("attribute %#x is %d bytes long", k, len(v))
+		}
+		buf = append(buf, byte(k), byte(len(v)>>8), byte(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf, nil
+}
+
+// proxyAttrs fills the detection result of a proxy from its attributes
+func proxyAttrs(attrs map[byte][]byte) (store.Proxy, error) {
+	p := store.Proxy{
+		Version:  string(attrs[attrVersion]),
+		Server:   string(attrs[attrServer]),
+		Response: attrs[attrResponse],
+	}
+	if auth := attrs[attrAuth]; len(auth) > 0 {
+		p.Auth = strings.Split(string(auth), ",")
+	}
+	if rtt := attrs[attrRTT]; len(rtt) > 0 {
+		us, err := strconv.ParseInt(string(rtt), 10, 64)
+		if err != nil {
+			return p, errors.Errorf("invalid rtt %q", rtt)
+		}
+		p.RTT = time.Duration(us) * time.Microsecond
+	}
+	for k, v := range attrs {
+		if name, ok := metaAttributes[k]; ok {
+			if p.Meta == nil {
+				p.Meta = make(map[string]string)
+			}
+			p.Meta[name] = string(v)
+		}
+	}
+	return p, nil
+}
+
+func decodeBatch(payload []byte) (*batch, error) {
+	d := &decoder{buf: payload}
+	b := &batch{id: d.uint32()}
+	meta := d.attrs()
+	b.scanID = string(meta[metaScanID])
+	b.walkerID = string(meta[metaWalkerID])
+	cnt := int(d.uint16())
+	for i := 0; i < cnt && d.err == nil; i++ {
+		code := d.byte()
+		addrLen := int(d.byte())
+		if d.err == nil && addrLen != net.IPv4len && addrLen != net.IPv6len {
+			return nil, errors.Errorf("invalid address length %d", addrLen)
+		}
+		addr := net.IP(d.next(addrLen))
+		port := d.uint16()
+		attrs := d.attrs()
+		if d.err != nil {
+			break
+		}
+		proto, ok := protocols[code]
+		if !ok {
+			return nil, errors.Errorf("unknown proxy protocol %#x", code)
+		}
+		p, err := proxyAttrs(attrs)
+		if err != nil {
+			return nil, err
+		}
+		p.Addr = append(net.IP(nil), addr...)
+		p.Port = port
+		p.Proto = proto
+		p.Scan = b.scanID
+		p.Walker = b.walkerID
+		b.proxies = append(b.proxies, p)
+	}
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "malformed batch")
+	}
+	if len(d.buf) != 0 {
+		return nil, errors.Errorf("%d trailing bytes in batch", len(d.buf))
+	}
+	return b, nil
+}
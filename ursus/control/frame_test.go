@@ -0,0 +1,260 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"ursus/jobs"
+	"ursus/store"
+)
+
+// golden frames, the uwalker encoder is tested against the same bytes
+var (
+	goldenV1Proxy = []byte{
+		0x02,               // proxy
+		0x01,               // socks5
+		184, 181, 217, 210, // ip
+		0x10, 0x31, // port 4145
+	}
+	goldenV2Heartbeat = []byte{
+		0x55, 0x02, 0x00, // magic, version, heartbeat
+		0x00, 0x00, 0x00, 0x00, // empty payload
+	}
+	goldenV2HeartbeatAck = []byte{
+		0x55, 0x02, 0x01,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	goldenV2Batch = []byte{
+		0x55, 0x02, 0x02, // magic, version, batch
+		0x00, 0x00, 0x00, 0x30, // payload length 48
+		0x00, 0x00, 0x00, 0x07, // batch id
+		0x02,                       // metadata count
+		0x01, 0x00, 0x02, 's', '1', // scan id
+		0x02, 0x00, 0x03, 'w', '-', '1', // walker id
+		0x00, 0x02, // proxies count
+		0x01, 0x04, 184, 181, 217, 210, 0x10, 0x31, 0x00, // socks5 184.181.217.210:4145
+		0x04, 0x10, // http, ipv6
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // 2001:db8::1
+		0x0c, 0x38, // port 3128
+		0x00, // no attributes
+	}
+	goldenV2BatchAck = []byte{
+		0x55, 0x02, 0x03,
+		0x00, 0x00, 0x00, 0x06,
+		0x00, 0x00, 0x00, 0x07, // batch id
+		0x00, 0x02, // saved
+	}
+)
+
+func Test_readV1Proxy(t *testing.T) {
+	p, err := readV1Proxy(bytes.NewReader(goldenV1Proxy[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Addr.Equal(net.ParseIP("184.181.217.210")) || p.Port != 4145 || p.Proto != "socks5" {
+		t.Errorf("readV1Proxy() = %v", p)
+	}
+
+	if _, err := readV1Proxy(bytes.NewReader([]byte{0x01, 1, 2, 3})); err == nil {
+		t.Error("readV1Proxy() accepted a truncated message")
+	}
+	if _, err := readV1Proxy(bytes.NewReader([]byte{0x09, 1, 2, 3, 4, 0, 80})); err == nil {
+		t.Error("readV1Proxy() accepted an unknown protocol")
+	}
+}
+
+func Test_readFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		kind    byte
+		wantErr bool
+	}{
+		{"heartbeat", goldenV2Heartbeat, frameHeartbeat, false},
+		{"batch", goldenV2Batch, frameBatch, false},
+		{"truncated header", goldenV2Batch[:5], 0, true},
+		{"truncated payload", goldenV2Batch[:20], 0, true},
+		{"bad magic", append([]byte{0x54}, goldenV2Heartbeat[1:]...), 0, true},
+		{"unknown version", append([]byte{0x55, 0x03}, goldenV2Heartbeat[2:]...), 0, true},
+		{"too large", []byte{0x55, 0x02, 0x02, 0xff, 0xff, 0xff, 0xff}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := readFrame(bytes.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readFrame() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (f.kind != tt.kind || len(f.payload) != len(tt.in)-headerLen) {
+				t.Errorf("readFrame() = %v", f)
+			}
+		})
+	}
+}
+
+// partialReader returns a single byte per read to imitate fragmented tcp segments
+type partialReader struct {
+	data []byte
+}
+
+func (r *partialReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func Test_readFrame_partial(t *testing.T) {
+	f, err := readFrame(&partialReader{goldenV2Batch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.kind != frameBatch || !bytes.Equal(f.payload, goldenV2Batch[headerLen:]) {
+		t.Errorf("readFrame() = %v", f)
+	}
+}
+
+func Test_decodeBatch(t *testing.T) {
+	b, err := decodeBatch(goldenV2Batch[headerLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.id != 7 || b.scanID != "s1" || b.walkerID != "w-1" {
+		t.Errorf("decodeBatch() header = %d %s %s", b.id, b.scanID, b.walkerID)
+	}
+	want := []store.Proxy{
+		{Addr: net.ParseIP("184.181.217.210"), Port: 4145, Proto: "socks5", Scan: "s1", Walker: "w-1"},
+		{Addr: net.ParseIP("2001:db8::1"), Port: 3128, Proto: "http", Scan: "s1", Walker: "w-1"},
+	}
+	if len(b.proxies) != len(want) {
+		t.Fatalf("decodeBatch() decoded %d proxies", len(b.proxies))
+	}
+	for i, p := range b.proxies {
+		w := want[i]
+		if !p.Addr.Equal(w.Addr) || p.Port != w.Port || p.Proto != w.Proto || p.Scan != w.Scan || p.Walker != w.Walker {
+			t.Errorf("decodeBatch() proxy %d = %v, want %v", i, p, w)
+		}
+	}
+
+	// unknown proxy attributes are skipped
+	b, err = decodeBatch([]byte{0, 0, 0, 1, 0, 0, 1, 0x01, 0x04, 1, 2, 3, 4, 0, 80, 1, 0x7f, 0x00, 0x01, 0x01})
+	if err != nil || len(b.proxies) != 1 || b.proxies[0].Port != 80 {
+		t.Errorf("decodeBatch() = %v, %v", b, err)
+	}
+
+	// known proxy attributes are decoded into the metadata
+	b, err = decodeBatch([]byte{0, 0, 0, 1, 0, 0, 1, 0x04, 0x04, 1, 2, 3, 4, 0x0c, 0x38, 2, 0x02, 0x00, 0x01, 'v', 0x7f, 0x00, 0x01, 0x01})
+	if err != nil || len(b.proxies) != 1 {
+		t.Fatalf("decodeBatch() = %v, %v", b, err)
+	}
+	if meta := b.proxies[0].Meta; len(meta) != 1 || meta["via"] != "v" {
+		t.Errorf("decodeBatch() proxy meta = %v", meta)
+	}
+
+	// the detection result
+	b, err = decodeBatch([]byte{0, 0, 0, 1, 0, 0, 1, 0x01, 0x04, 1, 2, 3, 4, 0x04, 0x38, 5,
+		0x01, 0x00, 0x01, 'd', // server
+		0x03, 0x00, 0x0d, 'n', 'o', 'n', 'e', ',', 'p', 'a', 's', 's', 'w', 'o', 'r', 'd', // auth
+		0x04, 0x00, 0x01, '5', // version
+		0x05, 0x00, 0x02, 0x05, 0x00, // response
+		0x06, 0x00, 0x04, '1', '5', '0', '0', // rtt
+	})
+	if err != nil || len(b.proxies) != 1 {
+		t.Fatalf("decodeBatch() = %v, %v", b, err)
+	}
+	p := b.proxies[0]
+	if p.Server != "d" || len(p.Auth) != 2 || p.Auth[0] != "none" || p.Auth[1] != "password" || p.Version != "5" ||
+		!bytes.Equal(p.Response, []byte{0x05, 0x00}) || p.RTT != 1500*time.Microsecond || p.Meta != nil {
+		t.Errorf("decodeBatch() proxy = %+v", p)
+	}
+	if _, err := decodeBatch([]byte{0, 0, 0, 1, 0, 0, 1, 0x01, 0x04, 1, 2, 3, 4, 0x04, 0x38, 1, 0x06, 0x00, 0x01, 'x'}); err == nil {
+		t.Error("decodeBatch() accepted an invalid rtt")
+	}
+
+	for _, bad := range [][]byte{
+		goldenV2Batch[headerLen : len(goldenV2Batch)-1],
+		append(append([]byte(nil), goldenV2Batch[headerLen:]...), 0x00),
+		{0, 0, 0, 1, 0, 0, 1, 0x01, 0x05, 1, 2, 3, 4, 5, 0, 80, 0},
+		{0, 0, 0, 1, 0, 0, 1, 0x09, 0x04, 1, 2, 3, 4, 0, 80, 0},
+	} {
+		if _, err := decodeBatch(bad); err == nil {
+			t.Errorf("decodeBatch(%v) accepted a malformed batch", bad)
+		}
+	}
+}
+
+func Test_writeFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeFrame(buf, frameHeartbeatAck, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), goldenV2HeartbeatAck) {
+		t.Errorf("writeFrame() = %x, want %x", buf.Bytes(), goldenV2HeartbeatAck)
+	}
+
+	buf.Reset()
+	if err := writeFrame(buf, frameBatchAck, encodeBatchAck(7, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), goldenV2BatchAck) {
+		t.Errorf("writeFrame() = %x, want %x", buf.Bytes(), goldenV2BatchAck)
+	}
+}
+
+func Test_decodeHeartbeat(t *testing.T) {
+	scan, err := decodeHeartbeat(goldenV2Heartbeat[headerLen:])
+	if err != nil || scan != nil {
+		t.Errorf("decodeHeartbeat() = %v, %v", scan, err)
+	}
+	scan, err = decodeHeartbeat([]byte{
+		0x03,                       // metadata count
+		0x01, 0x00, 0x02, 's', '1', // scan id
+		0x04, 0x00, 0x04, '1', '0', '8', '0', // ports
+		0x05, 0x00, 0x03, '1', '0', '0', // rate
+	})
+	if err != nil || *scan != (Scan{ID: "s1", Ports: "1080", Rate: "100"}) {
+		t.Errorf("decodeHeartbeat() = %v, %v", scan, err)
+	}
+	if _, err := decodeHeartbeat([]byte{0x01, 0x01, 0x00}); err == nil {
+		t.Error("decodeHeartbeat() accepted a malformed heartbeat")
+	}
+}
+
+func Test_encodeShard_manyTargets(t *testing.T) {
+	targets := make([]string, 6000)
+	for i := range targets {
+		targets[i] = fmt.Sprintf("10.%d.%d.1/32", i/256, i%256)
+	}
+	q := jobs.NewQueue()
+	if _, err := q.Submit(targets, "1080", 100); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for shard := q.Next("w", 1); shard != nil; shard = q.Next("w", 1) {
+		payload, err := encodeShard(shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &decoder{buf: payload}
+		attrs := d.attrs()
+		if d.err != nil || len(d.buf) != 0 || string(attrs[metaShardID]) != shard.ID {
+			t.Fatalf("shard %s is decoded as %v, %v", shard.ID, attrs, d.err)
+		}
+		got = append(got, strings.Split(string(attrs[metaTargets]), ",")...)
+	}
+	if len(got) != len(targets) {
+		t.Errorf("%d targets are decoded, want %d", len(got), len(targets))
+	}
+}
+
+func Test_encodeAttrs_tooLong(t *testing.T) {
+	if _, err := encodeAttrs(map[byte]string{metaTargets: strings.Repeat("a", 0x10000)}); err == nil {
+		t.Error("encodeAttrs() accepted a value longer than 64 KiB")
+	}
+}
@@ -0,0 +1,123 @@
+package control
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// walkers send heartbeats every second, a walker is considered dead after missing a few of them
+const (
+	heartbeatInterval = time.Second
+	staleAfter        = 3 * heartbeatInterval
+	// forgetAfter is how long disconnected walkers are kept in the registry
+	forgetAfter = 24 * time.Hour
+)
+
+// Scan describes what the walker is scanning, as reported with heartbeats
+type Scan struct {
+	ID      string `json:"id,omitempty"`
+	Targets string `json:"targets,omitempty"`
+	Ports   string `json:"ports,omitempty"`
+	Rate    string `json:"rate,omitempty"`
+}
+
+type Walker struct {
+	ID             string    `json:"id"`
+	Addr           string    `json:"addr"`
+	Connected      bool      `json:"connected"`
+	ConnectedSince time.Time `json:"connected_since"`
+	LastHeartbeat  time.Time `json:"last_heartbeat"`
+	Proxies        int64     `json:"proxies"`
+	Scan           *Scan     `json:"scan,omitempty"`
+
+	// Alive is false for walkers that are disconnected or missed heartbeats
+	Alive            bool `json:"alive"`
+	MissedHeartbeats int  `json:"missed_heartbeats"`
+}
+
+// Registry keeps track of walkers connected to the control server.
+// Walkers are identified by id, a reconnect of the walker replaces its previous session.
+type Registry struct {
+	mu      sync.Mutex
+	walkers map[string]*entry
+	now     func() time.Time
+}
+
+// entry is a connection of a walker
+type entry struct {
+	Walker
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		walkers: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+func (r *Registry) connect(id, addr string) *entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	s := &entry{Walker{
+		ID:             id,
+		Addr:           addr,
+		Connected:      true,
+		ConnectedSince: now,
+		LastHeartbeat:  now,
+	}}
+	if prev, ok := r.walkers[id]; ok {
+		s.Proxies = prev.Proxies
+		s.Scan = prev.Scan
+	}
+	r.walkers[id] = s
+	return s
+}
+
+func (r *Registry) heartbeat(s *entry, scan *Scan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.LastHeartbeat = r.now()
+	if scan != nil {
+		s.Scan = scan
+	}
+}
+
+func (r *Registry) reported(s *entry, cnt int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.LastHeartbeat = r.now() // any message proves the walker is alive
+	s.Proxies += int64(cnt)
+}
+
+func (r *Registry) disconnect(s *entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.Connected = false
+}
+
+// Walkers returns the known walkers sorted by id
+func (r *Registry) Walkers() []Walker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	res := make([]Walker, 0, len(r.walkers))
+	for id, s := range r.walkers {
+		silence := now.Sub(s.LastHeartbeat)
+		if !s.Connected && silence > forgetAfter {
+			delete(r.walkers, id)
+			continue
+		}
+		w := s.Walker
+		if silence > heartbeatInterval {
+			w.MissedHeartbeats = int(silence/heartbeatInterval) - 1
+		}
+		w.Alive = w.Connected && silence <= staleAfter
+		res = append(res, w)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
@@ -0,0 +1,64 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestRegistry_Walkers(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	r := NewRegistry()
+	r.now = clock.now
+
+	a := r.connect("a", "10.0.0.1:5000")
+	b := r.connect("b", "10.0.0.2:5000")
+	r.reported(a, 3)
+	r.heartbeat(b, &Scan{ID: "s1", Ports: "1080"})
+
+	clock.t = clock.t.Add(2500 * time.Millisecond)
+	r.heartbeat(a, nil)
+	walkers := r.Walkers()
+	if len(walkers) != 2 {
+		t.Fatalf("Walkers() = %v", walkers)
+	}
+	if w := walkers[0]; w.ID != "a" || !w.Alive || w.MissedHeartbeats != 0 || w.Proxies != 3 || w.Scan != nil {
+		t.Errorf("walker a = %+v", w)
+	}
+	if w := walkers[1]; w.ID != "b" || !w.Alive || w.MissedHeartbeats != 1 || w.Scan.ID != "s1" {
+		t.Errorf("walker b = %+v", w)
+	}
+
+	// b stops sending heartbeats
+	clock.t = clock.t.Add(2 * time.Second)
+	r.heartbeat(a, nil)
+	walkers = r.Walkers()
+	if w := walkers[1]; w.Alive || w.MissedHeartbeats != 3 {
+		t.Errorf("walker b = %+v", w)
+	}
+
+	// a reconnects, its counters are kept
+	r.disconnect(a)
+	if w := r.Walkers()[0]; w.Alive || w.Connected {
+		t.Errorf("walker a = %+v", w)
+	}
+	a2 := r.connect("a", "10.0.0.1:5001")
+	r.disconnect(a) // the previous session ends after the new one started
+	if w := r.Walkers()[0]; !w.Alive || w.Proxies != 3 || w.Addr != "10.0.0.1:5001" {
+		t.Errorf("walker a = %+v", w)
+	}
+	r.disconnect(a2)
+	r.disconnect(b)
+
+	clock.t = clock.t.Add(forgetAfter + time.Second)
+	if walkers := r.Walkers(); len(walkers) != 0 {
+		t.Errorf("disconnected walkers are not forgotten: %v", walkers)
+	}
+}
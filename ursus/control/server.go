@@ -1,12 +1,16 @@
 package control
 
 import (
+	"bufio"
 	"context"
 	"github.com/pkg/errors"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+	"ursus/jobs"
 	"ursus/store"
 )
 
@@ -16,10 +20,6 @@ const (
 	proxyRcv = 0x2
 )
 
-const (
-	socks5 = 0x1
-)
-
 var ackBuf = []byte{hbAck}
 
 type Server interface {
@@ -28,28 +28,46 @@ type Server interface {
 }
 
 type srv struct {
+	// sessions counts the v2 connections, it is the first to keep it aligned on 32-bit platforms
+	sessions uint64
+
 	l       net.Listener
 	done    chan struct{}
 	tasks   chan net.Conn
 	workers int
 	wg      sync.WaitGroup
 	store   store.ProxyStore
+	// key authenticates walkers, nil if authentication is disabled
+	key      []byte
+	registry *Registry
+	// queue hands out scan jobs to walkers, nil if jobs are not dispatched
+	queue *jobs.Queue
 }
 
-func NewServer(bind string, workers int, store store.ProxyStore) (Server, error) {
+// NewServer creates the control server. Walkers must prove they know the key unless it is empty.
+func NewServer(bind string, workers int, store store.ProxyStore, key string, registry *Registry, queue *jobs.Queue) (Server, error) {
 	l, err := net.Listen("tcp4", bind)
 	if err != nil {
 		return nil, errors.Wrap(err, "error starting listening socket")
 	}
 	done := make(chan struct{})
 	tasks := make(chan net.Conn)
+	var k []byte
+	if key != "" {
+		k = []byte(key)
+	} else {
+		log.Println("Control key is not configured, walkers are not authenticated")
+	}
 	return &srv{
-		l:       l,
-		done:    done,
-		tasks:   tasks,
-		workers: workers,
-		wg:      sync.WaitGroup{},
-		store:   store,
+		l:        l,
+		done:     done,
+		tasks:    tasks,
+		workers:  workers,
+		wg:       sync.WaitGroup{},
+		store:    store,
+		key:      k,
+		registry: registry,
+		queue:    queue,
 	}, nil
 }
 
@@ -97,52 +115,152 @@ func (s *srv) worker() {
 
 func (s *srv) handle(conn net.Conn) {
 	defer conn.Close()
+	r := bufio.NewReader(conn)
+	setDeadline(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		log.Printf("Error reading from the socket: %s", err)
+		return
+	}
+	if first[0] == frameMagic {
+		err = s.handleV2(conn, r)
+	} else {
+		err = s.handleV1(conn, r)
+	}
+	if err != nil && err != io.EOF && err != errUnauthenticated {
+		log.Printf("Closing connection with %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *srv) handleV1(conn net.Conn, r *bufio.Reader) error {
+	if s.key != nil {
+		s.reject(conn, "", "v1 protocol can't be authenticated")
+		return errUnauthenticated
+	}
+	// v1 walkers don't have an identity, so they are distinguished by the address, several of them may share a host
+	ses := s.registry.connect(conn.RemoteAddr().String(), conn.RemoteAddr().String())
+	defer s.registry.disconnect(ses)
 	for {
 		setDeadline(conn)
-		buf := make([]byte, 8)
-		cnt, err := conn.Read(buf)
-		if err != nil || cnt == 0 {
-			log.Printf("Error reading from the socket: %s", err)
-			return
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
 		}
-		switch buf[0] {
+		switch kind {
 		case hbRcv:
-			if cnt != 1 {
-				return
-			}
+			s.registry.heartbeat(ses, nil)
 		case proxyRcv:
-			if cnt != 8 {
-				return
+			proxy, err := readV1Proxy(r)
+			if err != nil {
+				return err
 			}
-			var proto string
-			switch buf[1] {
-			case socks5:
-				proto = "socks5"
-			default:
-				log.Printf("Unknown proxy protocol %s", buf[1])
-				return
+			proxy.Updated = time.Now()
+			if err := s.store.Save(context.Background(), *proxy); err != nil {
+				log.Printf("Error saving proxy %v, %s", proxy, err)
+				break
 			}
-			ip := net.IP(buf[2:6])
-			port := uint16(16*buf[6] + buf[6])
-			proxy := store.Proxy{
-				Addr:    ip,
-				Port:    port,
-				Proto:   proto,
-				Updated: time.Now(),
+			s.registry.reported(ses, 1)
+		default:
+			return errors.Errorf("unknown message type %#x", kind)
+		}
+		if err := sendAck(conn); err != nil {
+			return errors.Wrap(err, "error writing ack")
+		}
+	}
+}
+
+func (s *srv) handleV2(conn net.Conn, r *bufio.Reader) error {
+	walkerID, err := s.authenticate(conn, r)
+	if err != nil {
+		return err
+	}
+	id := walkerID
+	if id == "" {
+		id = remoteHost(conn)
+	}
+	ses := s.registry.connect(id, conn.RemoteAddr().String())
+	defer s.registry.disconnect(ses)
+	// the shards are leased by the connection, a stale connection of a reconnected walker releases only its own
+	lease := atomic.AddUint64(&s.sessions, 1)
+	if s.queue != nil {
+		defer s.queue.Release(id, lease)
+	}
+	for {
+		setDeadline(conn)
+		f, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		switch f.kind {
+		case frameHeartbeat:
+			var scan *Scan
+			if scan, err = decodeHeartbeat(f.payload); err != nil {
+				return err
 			}
-			err := s.store.Save(context.Background(), proxy)
-			if err != nil {
-				log.Printf("Error saving proxy %v, %s", proxy, err)
+			s.registry.heartbeat(ses, scan)
+			err = writeFrame(conn, frameHeartbeatAck, nil)
+		case frameBatch:
+			var b *batch
+			if b, err = decodeBatch(f.payload); err != nil {
+				return err
+			}
+			if walkerID != "" {
+				b.setWalker(walkerID) // the authenticated identity wins over the reported one
+			}
+			saved := s.saveBatch(b)
+			s.registry.reported(ses, int(saved))
+			setDeadline(conn)
+			err = writeFrame(conn, frameBatchAck, encodeBatchAck(b.id, saved))
+		case frameShardRequest:
+			var shard *jobs.Shard
+			if s.queue != nil {
+				shard = s.queue.Next(id, lease)
 			}
+			payload, encErr := encodeShard(shard)
+			if encErr != nil {
+				// the shard would fail on any walker, it is completed to leave the queue
+				log.Printf("Error encoding shard %s: %s", shard.ID, encErr)
+				if err := s.queue.Complete(id, shard.ID); err != nil {
+					log.Printf("Error completing shard: %s", err)
+				}
+				shard = nil
+			}
+			if shard != nil {
+				log.Printf("Shard %s is assigned to walker %q", shard.ID, id)
+			}
+			err = writeFrame(conn, frameShard, payload)
+		case frameShardDone:
+			var shardID string
+			if shardID, err = decodeShardDone(f.payload); err != nil {
+				return err
+			}
+			if s.queue != nil {
+				if err := s.queue.Complete(id, shardID); err != nil {
+					log.Printf("Error completing shard: %s", err)
+				}
+			}
+			err = writeFrame(conn, frameShardDoneAck, nil)
 		default:
-			return
+			return errors.Errorf("unknown frame type %#x", f.kind)
 		}
-		err = sendAck(conn)
 		if err != nil {
-			log.Printf("Error writing heartbeat %s", err)
+			return errors.Wrap(err, "error writing ack")
 		}
+	}
+}
 
+func (s *srv) saveBatch(b *batch) uint16 {
+	var saved uint16
+	now := time.Now()
+	for _, proxy := range b.proxies {
+		proxy.Updated = now
+		if err := s.store.Save(context.Background(), proxy); err != nil {
+			log.Printf("Error saving proxy %v, %s", proxy, err)
+			continue
+		}
+		saved++
 	}
+	return saved
 }
 
 func sendAck(conn net.Conn) error {
@@ -155,6 +273,14 @@ func sendAck(conn net.Conn) error {
 	return err
 }
 
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
 func setDeadline(conn net.Conn) {
 	err := conn.SetDeadline(time.Now().Add(2 * time.Second))
 	if err != nil {
@@ -0,0 +1,196 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"ursus/jobs"
+	"ursus/store"
+)
+
+type memStore struct {
+	mu      sync.Mutex
+	proxies []store.Proxy
+}
+
+func (m *memStore) Save(_ context.Context, proxy store.Proxy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.proxies = append(m.proxies, proxy)
+	return nil
+}
+
+func (m *memStore) FindAll(context.Context, int64, int64) ([]store.Proxy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.proxies, nil
+}
+
+func (m *memStore) Close() {}
+
+// session runs handle on one end of a pipe and returns the other end
+func session(t *testing.T, s *srv) (net.Conn, <-chan struct{}) {
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handle(server)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client, done
+}
+
+func expect(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestSrv_handleV1(t *testing.T) {
+	st := &memStore{}
+	conn, _ := session(t, &srv{store: st, registry: NewRegistry()})
+
+	for _, msg := range [][]byte{{hbRcv}, goldenV1Proxy, {hbRcv}} {
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, ackBuf)
+	}
+	proxies, _ := st.FindAll(context.Background(), 0, 0)
+	if len(proxies) != 1 || proxies[0].Port != 4145 || !proxies[0].Addr.Equal(net.IPv4(184, 181, 217, 210)) {
+		t.Errorf("saved %v", proxies)
+	}
+}
+
+// remoteConn is a pipe end connected from the addr
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestSrv_handleV1_sharedHost(t *testing.T) {
+	s := &srv{store: &memStore{}, registry: NewRegistry()}
+	for _, port := range []int{40000, 40001} {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			s.handle(remoteConn{server, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}})
+			close(done)
+		}()
+		t.Cleanup(func() {
+			client.Close()
+			<-done
+		})
+		if _, err := client.Write([]byte{hbRcv}); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, client, ackBuf)
+	}
+	walkers := s.registry.Walkers()
+	if len(walkers) != 2 || walkers[0].ID != "10.0.0.1:40000" || walkers[1].ID != "10.0.0.1:40001" {
+		t.Errorf("Walkers() = %+v", walkers)
+	}
+}
+
+func TestSrv_handleV2(t *testing.T) {
+	st := &memStore{}
+	s := &srv{store: st, registry: NewRegistry()}
+	conn, done := session(t, s)
+
+	// frames are written byte by byte to make sure partial reads are handled
+	for _, b := range goldenV2Heartbeat {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(t, conn, goldenV2HeartbeatAck)
+	if _, err := conn.Write(goldenV2Batch); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, goldenV2BatchAck)
+	proxies, _ := st.FindAll(context.Background(), 0, 0)
+	if len(proxies) != 2 {
+		t.Fatalf("saved %v", proxies)
+	}
+	if walkers := s.registry.Walkers(); len(walkers) != 1 || walkers[0].Proxies != 2 || !walkers[0].Connected {
+		t.Errorf("registered walkers %v", walkers)
+	}
+
+	// v1 messages are not accepted after v2 was negotiated
+	if _, err := conn.Write(goldenV1Proxy); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if walkers := s.registry.Walkers(); walkers[0].Connected {
+		t.Errorf("walker is not disconnected %v", walkers)
+	}
+}
+
+func TestSrv_handleV2_shards(t *testing.T) {
+	queue := jobs.NewQueue()
+	s := &srv{store: &memStore{}, registry: NewRegistry(), queue: queue}
+	conn, done := session(t, s)
+	if _, err := conn.Write(goldenV2Hello); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, []byte{0x55, 0x02, frameAuthOk, 0, 0, 0, 0})
+
+	// no jobs yet
+	if err := writeFrame(conn, frameShardRequest, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, []byte{0x55, 0x02, frameShard, 0, 0, 0, 0})
+
+	if _, err := queue.Submit([]string{"10.0.0.0/16", "10.1.0.0/16"}, "1080", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, frameShardRequest, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, []byte{
+		0x55, 0x02, frameShard, 0, 0, 0, 0x2d,
+		0x05,
+		0x01, 0x00, 0x05, 'j', 'o', 'b', '-', '1',
+		0x03, 0x00, 0x0b, '1', '0', '.', '0', '.', '0', '.', '0', '/', '1', '6',
+		0x04, 0x00, 0x04, '1', '0', '8', '0',
+		0x05, 0x00, 0x02, '5', '0',
+		0x06, 0x00, 0x07, 'j', 'o', 'b', '-', '1', '-', '0',
+	})
+	shardDone, err := encodeAttrs(map[byte]string{metaShardID: "job-1-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, frameShardDone, shardDone); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, []byte{0x55, 0x02, frameShardDoneAck, 0, 0, 0, 0})
+
+	// the second shard is taken and the walker disconnects
+	if err := writeFrame(conn, frameShardRequest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFrame(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-done
+	if j := queue.Jobs()[0]; j.Done != 1 || j.Assigned != 0 {
+		t.Errorf("job progress = %+v", j)
+	}
+	if shard := queue.Next("another", 0); shard == nil || shard.ID != "job-1-1" {
+		t.Errorf("shard of the disconnected walker is not released: %v", shard)
+	}
+}
@@ -0,0 +1,253 @@
+package jobs
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shardBits limits the shard size to 2^shardBits addresses
+	shardBits = 16
+	maxShards = 1 << 16
+	// maxTargetsLen limits the length of the comma separated targets of a shard, they are sent to walkers as one attribute
+	maxTargetsLen = 0xFFFF
+)
+
+// Job is a scan requested by the operator. It is split into shards scanned by walkers.
+type Job struct {
+	ID      string    `json:"id"`
+	Targets []string  `json:"targets"`
+	Ports   string    `json:"ports"`
+	Rate    uint32    `json:"rate"`
+	Created time.Time `json:"created"`
+
+	Shards   int `json:"shards"`
+	Assigned int `json:"assigned"`
+	Done     int `json:"done"`
+}
+
+// Shard is a part of a job scanned by a single walker
+type Shard struct {
+	ID      string
+	Job     string
+	Targets []string
+	Ports   string
+	Rate    uint32
+
+	// walker is the id of the walker scanning the shard, empty if it is pending,
+	// session is the connection of the walker the shard is assigned in
+	walker  string
+	session uint64
+}
+
+// Queue keeps jobs and hands their shards out to walkers in the submission order.
+// Shards assigned to a walker return to the queue when the walker is gone, completed shards are removed.
+type Queue struct {
+	mu     sync.Mutex
+	seq    int
+	jobs   []*Job
+	shards []*Shard
+}
+
+func NewQueue() *Queue {
+	return &Queue{}
+}
+
+// Submit splits the job into shards and enqueues them
+func (q *Queue) Submit(targets []string, ports string, rate uint32) (*Job, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("no targets to scan")
+	}
+	if ports == "" {
+		return nil, errors.New("no ports to scan")
+	}
+	groups, err := split(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	job := &Job{
+		ID:      fmt.Sprintf("job-%d", q.seq),
+		Targets: targets,
+		Ports:   ports,
+		Rate:    rate,
+		Created: time.Now(),
+		Shards:  len(groups),
+	}
+	for i, g := range groups {
+		q.shards = append(q.shards, &Shard{
+			ID:      fmt.Sprintf("%s-%d", job.ID, i),
+			Job:     job.ID,
+			Targets: g,
+			Ports:   ports,
+			Rate:    rate,
+		})
+	}
+	q.jobs = append(q.jobs, job)
+	return job, nil
+}
+
+// Next assigns the first pending shard to the walker connected in the session. It returns nil if there is nothing to scan.
+func (q *Queue) Next(walker string, session uint64) *Shard {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range q.shards {
+		if s.walker != "" {
+			continue
+		}
+		s.walker, s.session = walker, session
+		q.job(s.Job).Assigned++
+		res := *s
+		return &res
+	}
+	return nil
+}
+
+// Complete marks the shard as scanned. A shard may be completed by a walker it was taken from
+// after a reconnect, the work is not lost in that case.
+func (q *Queue) Complete(walker, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, s := range q.shards {
+		if s.ID != id {
+			continue
+		}
+		if s.walker != walker {
+			log.Printf("Shard %s assigned to %q is completed by %q", id, s.walker, walker)
+		}
+		job := q.job(s.Job)
+		if s.walker != "" {
+			job.Assigned--
+		}
+		job.Done++
+		q.shards = append(q.shards[:i], q.shards[i+1:]...)
+		return nil
+	}
+	return errors.Errorf("unknown shard %s", id)
+}
+
+// Release returns shards assigned to the walker in the session to the queue.
+// The shards assigned after a reconnect of the walker are kept by its new session.
+func (q *Queue) Release(walker string, session uint64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	released := 0
+	for _, s := range q.shards {
+		if s.walker != walker || s.session != session {
+			continue
+		}
+		s.walker, s.session = "", 0
+		q.job(s.Job).Assigned--
+		released++
+	}
+	if released > 0 {
+		log.Printf("%d shards of walker %q are returned to the queue", released, walker)
+	}
+	return released
+}
+
+// Jobs returns the submitted jobs with their progress
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := make([]Job, len(q.jobs))
+	for i, j := range q.jobs {
+		res[i] = *j
+	}
+	return res
+}
+
+func (q *Queue) job(id string) *Job {
+	for _, j := range q.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	panic("shard without a job " + id)
+}
+
+// split divides targets into groups of subnets with at most 2^shardBits addresses
+// and maxTargetsLen bytes of the joined targets each
+func split(targets []string) ([][]string, error) {
+	var subnets []*net.IPNet
+	for _, t := range targets {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(t))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid target %s", t)
+		}
+		ones, bits := n.Mask.Size()
+		if bits-ones <= shardBits {
+			subnets = append(subnets, n)
+			continue
+		}
+		if bits-ones-shardBits > 16 {
+			return nil, errors.Errorf("target %s is too large", t)
+		}
+		subnets = append(subnets, subdivide(n, bits-shardBits)...)
+		if len(subnets) > maxShards {
+			return nil, errors.New("too many shards")
+		}
+	}
+	// the largest subnets first: sizes are powers of two, so a group is full once the next subnet doesn't fit
+	sort.SliceStable(subnets, func(i, j int) bool {
+		return size(subnets[i]) > size(subnets[j])
+	})
+	var groups [][]string
+	var last uint64
+	var length int
+	for _, n := range subnets {
+		t := n.String()
+		if len(groups) == 0 || last+size(n) > 1<<shardBits || length+1+len(t) > maxTargetsLen {
+			groups = append(groups, nil)
+			last, length = 0, -1 // the first target has no comma
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], t)
+		last += size(n)
+		length += 1 + len(t)
+	}
+	if len(groups) > maxShards {
+		return nil, errors.New("too many shards")
+	}
+	return groups, nil
+}
+
+func size(n *net.IPNet) uint64 {
+	ones, bits := n.Mask.Size()
+	return 1 << uint(bits-ones)
+}
+
+// subdivide splits the subnet into subnets with the given prefix length
+func subdivide(n *net.IPNet, ones int) []*net.IPNet {
+	ownOnes, bits := n.Mask.Size()
+	cnt := 1 << uint(ones-ownOnes)
+	res := make([]*net.IPNet, 0, cnt)
+	ip := make(net.IP, len(n.IP))
+	copy(ip, n.IP)
+	for i := 0; i < cnt; i++ {
+		sub := &net.IPNet{IP: make(net.IP, len(ip)), Mask: net.CIDRMask(ones, bits)}
+		copy(sub.IP, ip)
+		res = append(res, sub)
+		add(ip, bits-ones)
+	}
+	return res
+}
+
+// add increments the ip by 2^shift
+func add(ip net.IP, shift int) {
+	i := len(ip) - 1 - shift/8
+	carry := uint(1) << uint(shift%8)
+	for ; i >= 0 && carry > 0; i-- {
+		sum := uint(ip[i]) + carry
+		ip[i] = byte(sum)
+		carry = sum >> 8
+	}
+}
@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_split(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		want    [][]string
+		wantErr bool
+	}{
+		{"single", []string{"10.0.0.0/24"}, [][]string{{"10.0.0.0/24"}}, false},
+		{"large", []string{"10.0.0.0/14"}, [][]string{
+			{"10.0.0.0/16"}, {"10.1.0.0/16"}, {"10.2.0.0/16"}, {"10.3.0.0/16"},
+		}, false},
+		{"packed", []string{"1.1.1.1/32", "10.0.0.0/17", "11.0.0.0/17", "12.0.0.0/24"}, [][]string{
+			{"10.0.0.0/17", "11.0.0.0/17"}, {"12.0.0.0/24", "1.1.1.1/32"},
+		}, false},
+		{"ipv6", []string{"2001:db8::/112"}, [][]string{{"2001:db8::/112"}}, false},
+		{"invalid", []string{"10.0.0.0"}, nil, true},
+		{"too large", []string{"2001:db8::/64"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := split(tt.targets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("split() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("split() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := NewQueue()
+	if _, err := q.Submit(nil, "1080", 100); err == nil {
+		t.Error("Submit() accepted a job without targets")
+	}
+	job, err := q.Submit([]string{"10.0.0.0/15"}, "1080", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Shards != 2 {
+		t.Fatalf("job is split into %d shards", job.Shards)
+	}
+
+	a := q.Next("a", 1)
+	b := q.Next("b", 2)
+	if a == nil || b == nil || a.ID == b.ID || a.Ports != "1080" || a.Rate != 100 {
+		t.Fatalf("Next() = %v, %v", a, b)
+	}
+	if s := q.Next("c", 3); s != nil {
+		t.Errorf("Next() = %v while all shards are assigned", s)
+	}
+
+	// walker a dies, its shard goes to c
+	if released := q.Release("a", 1); released != 1 {
+		t.Errorf("Release() = %d", released)
+	}
+	c := q.Next("c", 3)
+	if c == nil || c.ID != a.ID {
+		t.Fatalf("Next() = %v, want %s", c, a.ID)
+	}
+	if err := q.Complete("c", c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Complete("c", c.ID); err == nil {
+		t.Error("Complete() accepted a shard twice")
+	}
+	if j := q.Jobs()[0]; j.Done != 1 || j.Assigned != 1 {
+		t.Errorf("job progress = %+v", j)
+	}
+	if err := q.Complete("b", b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if j := q.Jobs()[0]; j.Done != 2 || j.Assigned != 0 {
+		t.Errorf("job progress = %+v", j)
+	}
+	if s := q.Next("a", 1); s != nil {
+		t.Errorf("Next() = %v after the job is done", s)
+	}
+}
+
+func TestQueue_reconnect(t *testing.T) {
+	q := NewQueue()
+	if _, err := q.Submit([]string{"10.0.0.0/15"}, "1080", 100); err != nil {
+		t.Fatal(err)
+	}
+	old := q.Next("a", 1)
+	// the walker reconnects before its stale session is closed
+	cur := q.Next("a", 2)
+	if old == nil || cur == nil {
+		t.Fatalf("Next() = %v, %v", old, cur)
+	}
+	if released := q.Release("a", 1); released != 1 {
+		t.Errorf("Release() = %d, want the shard of the stale session only", released)
+	}
+	if s := q.Next("b", 3); s == nil || s.ID != old.ID {
+		t.Errorf("Next() = %v, want %s", s, old.ID)
+	}
+	if s := q.Next("b", 3); s != nil {
+		t.Errorf("Next() = %v, the shard of the new session is handed out twice", s)
+	}
+}
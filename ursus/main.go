@@ -8,15 +8,20 @@ import (
 	"syscall"
 	"ursus/api"
 	"ursus/control"
+	"ursus/jobs"
 	"ursus/store"
 )
 
 type Config struct {
 	ControlAddress string           `json:"control_address"`
+	ControlKey     string           `json:"control_key"`
+	ControlWorkers int              `json:"control_workers"`
 	HttpAddress    string           `json:"http_address"`
 	Mongo          store.ClientConf `json:"mongo"`
 }
 
+const defaultControlWorkers = 64
+
 func readConfig() Config {
 	file, _ := os.Open("config.json")
 	defer file.Close()
@@ -52,12 +57,17 @@ func main() {
 	if err != nil {
 		log.Fatal("Couldn't create mongo connection: ", err)
 	}
-	server, err := control.NewServer(config.ControlAddress, 1, s)
+	if config.ControlWorkers <= 0 {
+		config.ControlWorkers = defaultControlWorkers
+	}
+	registry := control.NewRegistry()
+	queue := jobs.NewQueue()
+	server, err := control.NewServer(config.ControlAddress, config.ControlWorkers, s, config.ControlKey, registry, queue)
 
 	if err != nil {
 		log.Fatal("Couldn't create control server: ", err)
 	}
 	server.Start()
-	rest := api.NewRest(s)
+	rest := api.NewRest(s, registry, queue)
 	rest.Run(3000)
 }
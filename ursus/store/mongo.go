@@ -49,8 +49,18 @@ func (m *mng) Save(ctx context.Context, proxy Proxy) error {
 		{"proto", proxy.Proto},
 	}
 	update := bson.D{{
-		"updated",
-		proxy.Updated,
+		"$set",
+		bson.D{
+			{"updated", proxy.Updated},
+			{"scan", proxy.Scan},
+			{"walker", proxy.Walker},
+			{"version", proxy.Version},
+			{"auth", proxy.Auth},
+			{"server", proxy.Server},
+			{"meta", proxy.Meta},
+			{"response", proxy.Response},
+			{"rtt", proxy.RTT},
+		},
 	}}
 	updateResult, err := m.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
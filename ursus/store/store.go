@@ -17,4 +17,16 @@ type Proxy struct {
 	Port    uint16    `json:"port"`
 	Proto   string    `json:"proto"`
 	Updated time.Time `json:"updated"`
+	// Scan and Walker identify the scan and the walker that found the proxy, if reported
+	Scan   string `json:"scan,omitempty"`
+	Walker string `json:"walker,omitempty"`
+	// Detection result reported by the walker: the protocol version, the accepted authentication methods,
+	// e.g. none or password, the proxy software, other protocol specific facts, the beginning of
+	// the first response and the time it took to receive it
+	Version  string            `json:"version,omitempty"`
+	Auth     []string          `json:"auth,omitempty"`
+	Server   string            `json:"server,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Response []byte            `json:"response,omitempty"`
+	RTT      time.Duration     `json:"rtt,omitempty"`
 }
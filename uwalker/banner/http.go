@@ -0,0 +1,89 @@
+package banner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxHeaderLen limits the buffered status line and headers
+	maxHeaderLen = 8 << 10
+	httpPrefix   = "HTTP/"
+)
+
+// HTTPProxy asks the server to tunnel to the sentinel host with CONNECT or to fetch its absolute URI with GET.
+// A web server answers such requests as well, so only a tunnel, a proxy authentication demand
+// or a response passed through a proxy, i.e. with a Via header, are accepted.
+type HTTPProxy struct {
+	Host string
+	Port uint16
+	// Get fetches the absolute URI of the host instead of tunneling to it
+	Get bool
+}
+
+func (h *HTTPProxy) Init() []byte {
+	host := net.JoinHostPort(h.Host, strconv.Itoa(int(h.Port)))
+	if h.Get {
+		return []byte("GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n")
+	}
+	return []byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n")
+}
+
+func (h *HTTPProxy) Read(data []byte) ([]byte, int, int, *Result) {
+	prefix := len(data)
+	if prefix > len(httpPrefix) {
+		prefix = len(httpPrefix)
+	}
+	if string(data[:prefix]) != httpPrefix[:prefix] {
+		return nil, 0, 0, nil
+	}
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(data) >= maxHeaderLen {
+			return nil, 0, 0, nil
+		}
+		return nil, 0, 1, nil // the headers span several segments
+	}
+	end += 4
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data[:end])), nil)
+	if err != nil {
+		return nil, 0, 0, nil
+	}
+	_ = resp.Body.Close()
+	if !h.proxy(resp) {
+		return nil, 0, 0, nil
+	}
+	res := &Result{
+		Proto:   "http",
+		Version: fmt.Sprintf("%d.%d", resp.ProtoMajor, resp.ProtoMinor),
+		Auth:    []string{"none"},
+		Server:  resp.Header.Get("Server"),
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		res.Auth = nil
+		for _, challenge := range resp.Header.Values("Proxy-Authenticate") {
+			if f := strings.Fields(challenge); len(f) > 0 {
+				res.Auth = append(res.Auth, strings.ToLower(f[0]))
+			}
+		}
+	}
+	if via := resp.Header.Get("Via"); via != "" {
+		res.Meta = map[string]string{"via": via}
+	}
+	return nil, end, 0, res
+}
+
+func (h *HTTPProxy) proxy(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") != "" {
+		return true
+	}
+	if h.Get {
+		return resp.Header.Get("Via") != ""
+	}
+	return resp.StatusCode == http.StatusOK
+}
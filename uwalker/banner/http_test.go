@@ -0,0 +1,106 @@
+package banner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// feed passes the replies to the state like the conductor does: the bytes left unconsumed
+// are passed again with the next reply
+func feed(s interface {
+	Read([]byte) ([]byte, int, int, *Result)
+}, replies [][]byte) (int, int, *Result) {
+	var buf []byte
+	var read, need int
+	var res *Result
+	for _, r := range replies {
+		buf = append(buf, r...)
+		_, read, need, res = s.Read(buf)
+		buf = buf[read:]
+	}
+	return read, need, res
+}
+
+func TestHTTPProxy_Init(t *testing.T) {
+	h := &HTTPProxy{Host: "example.com", Port: 80}
+	assert.Equal(t, "CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\n\r\n", string(h.Init()))
+	h.Get = true
+	assert.Equal(t, "GET http://example.com:80/ HTTP/1.1\r\nHost: example.com:80\r\nConnection: close\r\n\r\n", string(h.Init()))
+}
+
+func TestHTTPProxy_Read(t *testing.T) {
+	tests := []struct {
+		name    string
+		get     bool
+		replies []string
+		res     *Result
+	}{
+		{
+			name:    "tunnel",
+			replies: []string{"HTTP/1.1 200 Connection established\r\n\r\n"},
+			res:     &Result{Proto: "http", Version: "1.1", Auth: []string{"none"}},
+		},
+		{
+			name:    "authentication required",
+			replies: []string{"HTTP/1.0 407 Proxy Authentication Required\r\nServer: squid/4.10\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nProxy-Authenticate: NTLM\r\n\r\n"},
+			res:     &Result{Proto: "http", Version: "1.0", Auth: []string{"basic", "ntlm"}, Server: "squid/4.10"},
+		},
+		{
+			name:    "fragmented",
+			replies: []string{"HT", "TP/1.1 200 OK\r\nVia: 1.1 tinyproxy (tinyproxy/1.11.0)\r\n", "\r\n"},
+			res: &Result{Proto: "http", Version: "1.1", Auth: []string{"none"},
+				Meta: map[string]string{"via": "1.1 tinyproxy (tinyproxy/1.11.0)"}},
+		},
+		{
+			name:    "web server rejects connect",
+			replies: []string{"HTTP/1.1 405 Method Not Allowed\r\nServer: nginx\r\n\r\n"},
+		},
+		{
+			name:    "407 without a challenge",
+			replies: []string{"HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"},
+		},
+		{
+			name:    "get through a proxy",
+			get:     true,
+			replies: []string{"HTTP/1.1 301 Moved Permanently\r\nServer: gws\r\nVia: 1.1 proxy\r\n\r\n<html>"},
+			res: &Result{Proto: "http", Version: "1.1", Auth: []string{"none"}, Server: "gws",
+				Meta: map[string]string{"via": "1.1 proxy"}},
+		},
+		{
+			name:    "get served by a web server",
+			get:     true,
+			replies: []string{"HTTP/1.1 200 OK\r\nServer: Apache\r\n\r\n<html>"},
+		},
+		{
+			name:    "not http",
+			replies: []string{"\x05\x00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HTTPProxy{Host: "example.com", Port: 80, Get: tt.get}
+			var replies [][]byte
+			for _, r := range tt.replies {
+				replies = append(replies, []byte(r))
+			}
+			read, need, res := feed(h, replies)
+			assert.Equal(t, tt.res, res)
+			assert.Equal(t, tt.res == nil, read == 0)
+			assert.Zero(t, need)
+		})
+	}
+}
+
+func TestHTTPProxy_Read_partial(t *testing.T) {
+	h := &HTTPProxy{Host: "example.com", Port: 80}
+	_, read, need, res := h.Read([]byte("HTTP/1.1 200 Connection established\r\n"))
+	assert.Nil(t, res)
+	assert.Zero(t, read)
+	assert.NotZero(t, need)
+
+	// the headers are consumed without the body
+	_, read, _, res = h.Read([]byte("HTTP/1.1 200 Connection established\r\n\r\n\x05\x00"))
+	assert.NotNil(t, res)
+	assert.Equal(t, 39, read)
+}
@@ -0,0 +1,23 @@
+package banner
+
+import (
+	"time"
+)
+
+// Result describes a detected proxy
+type Result struct {
+	Proto string
+	// Version is the protocol version spoken by the proxy, e.g 1.1 for http
+	Version string
+	// Auth lists the authentication methods accepted by the proxy, none for open proxies
+	Auth []string
+	// Server is the proxy software if it introduces itself
+	Server string
+	// Meta contains other protocol specific facts, e.g the Via header of http proxies
+	Meta map[string]string
+
+	// Response is the beginning of the first response of the proxy
+	Response []byte
+	// RTT is the time between sending the first request and receiving the response
+	RTT time.Duration
+}
@@ -0,0 +1,60 @@
+package banner
+
+import (
+	"encoding/binary"
+)
+
+const (
+	socks4Version   = 0x04
+	socks4Connect   = 0x01
+	socks4ReplyLen  = 8
+	socks4Granted   = 0x5A
+	socks4Rejected  = 0x5B
+	socks4NoIdentd  = 0x5C
+	socks4IdentFail = 0x5D
+)
+
+// Socks4 requests a connection to the sentinel host with the SOCKS4a extension.
+// Only a SOCKS4a server resolves the host and grants the request, so the grant proves the extension.
+// A rejection doesn't tell whether the server is a plain SOCKS4 one or failed to reach the host or identd,
+// it's reported as socks4 with the reason in the status.
+type Socks4 struct {
+	Host string
+	Port uint16
+}
+
+func (s *Socks4) Init() []byte {
+	req := []byte{socks4Version, socks4Connect, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(req[2:], s.Port)
+	req = append(req, 0) // empty user id
+	req = append(req, s.Host...)
+	return append(req, 0)
+}
+
+func (s *Socks4) Read(data []byte) ([]byte, int, int, *Result) {
+	// some servers reply with the version instead of the null byte
+	if data[0] != 0x00 && data[0] != socks4Version {
+		return nil, 0, 0, nil
+	}
+	if len(data) < socks4ReplyLen {
+		return nil, 0, socks4ReplyLen - len(data), nil
+	}
+	res := &Result{Version: "4"}
+	if data[1] == socks4Granted {
+		res.Proto = "socks4a"
+		return nil, socks4ReplyLen, 0, res
+	}
+	status, ok := socks4Rejections[data[1]]
+	if !ok {
+		return nil, 0, 0, nil
+	}
+	res.Proto = "socks4"
+	res.Meta = map[string]string{"status": status}
+	return nil, socks4ReplyLen, 0, res
+}
+
+var socks4Rejections = map[byte]string{
+	socks4Rejected:  "rejected",
+	socks4NoIdentd:  "no identd",
+	socks4IdentFail: "ident failed",
+}
@@ -0,0 +1,80 @@
+package banner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocks4_Init(t *testing.T) {
+	s := &Socks4{Host: "example.com", Port: 80}
+	assert.Equal(t, append([]byte{
+		0x04, 0x01, // version, connect
+		0x00, 0x50, // port 80
+		0x00, 0x00, 0x00, 0x01, // invalid ip marks the SOCKS4a request
+		0x00, // user id
+	}, "example.com\x00"...), s.Init())
+}
+
+func TestSocks4_Read(t *testing.T) {
+	tests := []struct {
+		name     string
+		replies  [][]byte
+		proto    string
+		status   string
+		finished bool
+		rejected bool
+	}{
+		{
+			name:     "granted",
+			replies:  [][]byte{{0x00, 0x5A, 0, 0, 0, 0, 0, 0}},
+			proto:    "socks4a",
+			finished: true,
+		},
+		{
+			name:     "rejected",
+			replies:  [][]byte{{0x00, 0x5B, 0, 0, 0, 0, 0, 0}},
+			proto:    "socks4",
+			status:   "rejected",
+			finished: true,
+		},
+		{
+			name:     "ident failed, version in reply",
+			replies:  [][]byte{{0x04, 0x5D, 0, 0, 0, 0, 0, 0}},
+			proto:    "socks4",
+			status:   "ident failed",
+			finished: true,
+		},
+		{
+			name:     "fragmented",
+			replies:  [][]byte{{0x00, 0x5A, 0, 0}, {0, 0, 0, 0}},
+			proto:    "socks4a",
+			finished: true,
+		},
+		{
+			name:     "socks5",
+			replies:  [][]byte{{0x05, 0x00}},
+			rejected: true,
+		},
+		{
+			name:     "unknown status",
+			replies:  [][]byte{{0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+			rejected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Socks4{Host: "example.com", Port: 80}
+			read, need, res := feed(s, tt.replies)
+			assert.Equal(t, tt.finished, res != nil)
+			assert.Equal(t, tt.rejected, read == 0 && need == 0)
+			if tt.finished {
+				want := &Result{Proto: tt.proto, Version: "4"}
+				if tt.status != "" {
+					want.Meta = map[string]string{"status": tt.status}
+				}
+				assert.Equal(t, want, res)
+			}
+		})
+	}
+}
@@ -4,20 +4,39 @@ import (
 	"uwalker/socks5"
 )
 
+// socks5Methods are the authentication methods offered to the server by their codes
+var socks5Methods = map[byte]string{
+	0x00: "none",
+	0x01: "gssapi",
+	0x02: "password",
+}
+
+var socks5Greeting = []byte{socks5.VersionByte, 0x03, 0x00, 0x01, 0x02}
+
+// socks5NoAcceptable is selected by the servers that accept none of the offered methods
+const socks5NoAcceptable = 0xFF
+
+// Socks5 offers the known authentication methods and records the one selected by the server
 type Socks5 struct {
 }
 
-func (s *Socks5) Read(data []byte) ([]byte, int, bool) {
-	if len(data) > 1 && data[0] == socks5.VersionByte && data[1] == 0x00 {
-		return nil, len(data), true
+func (s *Socks5) Read(data []byte) ([]byte, int, int, *Result) {
+	if data[0] != socks5.VersionByte {
+		return nil, 0, 0, nil
 	}
-	return nil, 0, false
+	if len(data) < 2 {
+		return nil, 0, 2 - len(data), nil
+	}
+	auth := "unacceptable"
+	if data[1] != socks5NoAcceptable {
+		var ok bool
+		if auth, ok = socks5Methods[data[1]]; !ok {
+			return nil, 0, 0, nil // the server selected a method that was not offered
+		}
+	}
+	return nil, 2, 0, &Result{Proto: "socks5", Version: "5", Auth: []string{auth}}
 }
 
 func (s *Socks5) Init() []byte {
-	return socks5.NoAuthHeader
-}
-
-func (s *Socks5) Proto() string {
-	return "socks5"
+	return socks5Greeting
 }
@@ -0,0 +1,39 @@
+package banner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocks5_Init(t *testing.T) {
+	assert.Equal(t, []byte{0x05, 0x03, 0x00, 0x01, 0x02}, (&Socks5{}).Init())
+}
+
+func TestSocks5_Read(t *testing.T) {
+	tests := []struct {
+		reply []byte
+		auth  string
+		need  int
+	}{
+		{[]byte{0x05, 0x00}, "none", 0},
+		{[]byte{0x05, 0x02}, "password", 0},
+		{[]byte{0x05, 0x01}, "gssapi", 0},
+		{[]byte{0x05, 0xFF}, "unacceptable", 0},
+		{[]byte{0x05, 0x03}, "", 0},
+		{[]byte{0x04, 0x00}, "", 0},
+		{[]byte{0x05}, "", 1},
+	}
+	for _, tt := range tests {
+		s := &Socks5{}
+		_, read, need, res := s.Read(tt.reply)
+		assert.Equal(t, tt.need, need, "%x", tt.reply)
+		if tt.auth == "" {
+			assert.Nil(t, res, "%x", tt.reply)
+			assert.Zero(t, read, "%x", tt.reply)
+			continue
+		}
+		assert.Equal(t, &Result{Proto: "socks5", Version: "5", Auth: []string{tt.auth}}, res, "%x", tt.reply)
+		assert.Equal(t, len(tt.reply), read, "%x", tt.reply)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"uwalker/gen"
+	"uwalker/scan"
+)
+
+// noLimit doesn't limit the rate, nothing is sent by the replay
+type noLimit struct{}
+
+func (noLimit) Limit(int64) bool { return true }
+
+// replay detects the protocols in the replies of a capture written with --pcap-out and writes them to w
+func replay(path string, detectors Detectors, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := scan.NewReplay(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("replaying %s: %s", path, r.Comment())
+	c := NewConductor(r, noLimit{}, detectors, Recovery{}, 0)
+	established := c.Collect(r.Packets(context.Background()))
+	targets := make(chan gen.Target)
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+	for e := range established {
+		if _, err := fmt.Fprintf(w, "%s:%d\t%s\t%s\n", e.Ip, e.Port, e.Proto, strings.Join(e.Auth, ",")); err != nil {
+			return errors.Wrap(err, "failed to write the detected protocols")
+		}
+	}
+	return nil
+}
+
+// captureComment describes the scan in the capture written with --pcap-out
+func captureComment() string {
+	scanned := targets(opts.Cidrs, opts.Subnet)
+	if opts.Worker {
+		scanned = "jobs of " + opts.Ursus
+	}
+	return fmt.Sprintf("uwalker scan of %s, ports %s, protocols %s, backend %s, source ports %s, started at %s",
+		scanned, opts.Ports, opts.Protocols, opts.Backend, opts.SourcePorts, time.Now().UTC().Format(time.RFC3339))
+}
+
+// recorder is the scanner recording the frames
+type recorder interface {
+	Record(w io.Writer, comment string) (func() error, error)
+}
+
+// record writes the frames of the scanner to the file, stop flushes and closes it
+func record(r recorder, path string) (stop func() error, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the capture")
+	}
+	flush, err := r.Record(f, captureComment())
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "failed to start the capture")
+	}
+	log.Printf("recording the frames to %s", path)
+	return func() error {
+		err := flush()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return errors.Wrap(err, "failed to write the capture")
+	}, nil
+}
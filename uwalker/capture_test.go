@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan.pcapng")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	intf := pcapgo.NgInterface{Name: "eth0", LinkType: layers.LinkTypeEthernet, TimestampResolution: 9}
+	w, err := pcapgo.NewNgWriterInterface(f, intf, pcapgo.NgWriterOptions{SectionInfo: pcapgo.NgSectionInfo{Comment: "test scan"}})
+	require.NoError(t, err)
+	_, err = w.AddInterface(intf)
+	require.NoError(t, err)
+
+	local, proxy := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	frame := func(src, dst net.IP, tcp layers.TCP, payload []byte) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		_ = tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			&layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+			ip, &tcp, gopacket.Payload(payload)))
+		return buf.Bytes()
+	}
+	// the SYN is sent through the first interface, the replies are received through the second one
+	for _, r := range []struct {
+		intf int
+		data []byte
+	}{
+		{0, frame(local, proxy, layers.TCP{SrcPort: 55324, DstPort: 1080, SYN: true, Seq: 1000}, nil)},
+		{1, frame(proxy, local, layers.TCP{SrcPort: 1080, DstPort: 55324, SYN: true, ACK: true, Seq: 5000, Ack: 1001}, nil)},
+		{1, frame(proxy, local, layers.TCP{SrcPort: 1080, DstPort: 55324, ACK: true, PSH: true, Seq: 5001, Ack: 1006}, []byte{5, 2})},
+	} {
+		ci := gopacket.CaptureInfo{CaptureLength: len(r.data), Length: len(r.data), InterfaceIndex: r.intf}
+		require.NoError(t, w.WritePacket(ci, r.data))
+	}
+	require.NoError(t, w.Flush())
+	require.NoError(t, f.Close())
+
+	detectors, err := parseDetectors("example.com:80", "socks5", nil)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.NoError(t, replay(path, detectors, &out))
+	assert.Equal(t, "10.0.0.2:1080\tsocks5\tpassword\n", out.String())
+
+	assert.Error(t, replay(filepath.Join(t.TempDir(), "missing.pcapng"), detectors, &out))
+}
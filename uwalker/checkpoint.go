@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"uwalker/gen"
+	"uwalker/storage"
+)
+
+const checkpointInterval = 10 * time.Second
+
+// scanID identifies the scan by its parameters, so a checkpoint is never applied to another scan.
+// The seed is zero if it is not specified.
+func scanID(cidrs []string, ports string, excludes []string, seed uint64) string {
+	h := sha256.New()
+	h.Write([]byte(strings.Join(cidrs, ",")))
+	h.Write([]byte{0})
+	h.Write([]byte(ports))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(excludes, ",")))
+	if seed != 0 {
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.FormatUint(seed, 10)))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// seed returns the seed of the target order. The order is derived from the scan id
+// if the seed is not specified, so resumed scans have the same order.
+func seed(id string, seed uint64) uint64 {
+	if seed != 0 {
+		return seed
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// checkpoint saves the position of the generator periodically until the returned function is called.
+// The function saves the final position, done tells whether the scan is finished.
+func checkpoint(store *storage.Store, g *gen.Generator, cp storage.Checkpoint) func(done bool) {
+	save := func(done bool) {
+		cp.Position = g.Position()
+		cp.Done = done
+		cp.Updated = time.Now()
+		if err := store.SaveCheckpoint(cp); err != nil {
+			log.Printf("failed to save the checkpoint of the scan %s: %v", cp.ScanID, err)
+		}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(checkpointInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				save(false)
+			}
+		}
+	}()
+	return func(done bool) {
+		close(stop)
+		<-stopped
+		save(done)
+	}
+}
+
+// resume moves the generator to the last checkpoint of the scan. It returns false if the scan is finished.
+func resume(store *storage.Store, g *gen.Generator, id string) (bool, error) {
+	last, err := store.LoadCheckpoint(id)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case last == nil:
+		log.Printf("no checkpoint of the scan %s, starting from the beginning", id)
+	case last.Done:
+		log.Printf("scan %s is finished at %s", id, last.Updated.Format(time.RFC3339))
+		return false, nil
+	default:
+		log.Printf("resuming scan %s from the target #%d", id, last.Position)
+		g.Resume(last.Position)
+	}
+	return true, nil
+}
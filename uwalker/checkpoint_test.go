@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+	"uwalker/gen"
+	"uwalker/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_scanID(t *testing.T) {
+	id := scanID([]string{"10.0.0.0/8"}, "1080", []string{"10.1.0.0/16"}, 0)
+	assert.Equal(t, id, scanID([]string{"10.0.0.0/8"}, "1080", []string{"10.1.0.0/16"}, 0))
+	assert.NotEqual(t, id, scanID([]string{"10.0.0.0/8"}, "1080,3128", []string{"10.1.0.0/16"}, 0))
+	assert.NotEqual(t, id, scanID([]string{"11.0.0.0/8"}, "1080", []string{"10.1.0.0/16"}, 0))
+	assert.NotEqual(t, id, scanID([]string{"10.0.0.0/8"}, "1080", nil, 0))
+	assert.NotEqual(t, id, scanID([]string{"10.0.0.0/8"}, "1080", []string{"10.1.0.0/16"}, 5))
+
+	assert.Equal(t, uint64(5), seed(id, 5))
+	assert.Equal(t, seed(id, 0), seed(id, 0))
+	assert.NotEqual(t, seed(id, 0), seed("other", 0))
+}
+
+func Test_resume(t *testing.T) {
+	engine, err := storage.NewSqlite(filepath.Join(t.TempDir(), "db.sqlite"))
+	require.NoError(t, err)
+	store, err := storage.NewStore(engine)
+	require.NoError(t, err)
+	cidrs := []string{"10.0.0.0/30", "10.0.1.0/30"}
+	ports := []uint16{1080}
+	var all []gen.Target
+	g, err := gen.NewGenerator(cidrs, nil, 9)
+	require.NoError(t, err)
+	for tg := range g.Targets(context.Background(), ports) {
+		all = append(all, tg)
+	}
+
+	g, err = gen.NewGenerator(cidrs, nil, 9)
+	require.NoError(t, err)
+	ok, err := resume(store, g, "s1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the scan is interrupted after the 6th target
+	stop := checkpoint(store, g, storage.Checkpoint{ScanID: "s1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	targets := g.Targets(ctx, ports)
+	for i := 0; i < 6; i++ {
+		<-targets
+	}
+	cancel()
+	for g.Position() != 5 {
+		time.Sleep(time.Millisecond) // the position is updated after the target is taken
+	}
+	stop(false)
+
+	g, err = gen.NewGenerator(cidrs, nil, 9)
+	require.NoError(t, err)
+	ok, err = resume(store, g, "s1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	var rest []gen.Target
+	for tg := range g.Targets(context.Background(), ports) {
+		rest = append(rest, tg)
+	}
+	assert.Equal(t, all[5:], rest)
+	stop = checkpoint(store, g, storage.Checkpoint{ScanID: "s1"})
+	stop(true)
+
+	ok, err = resume(store, g, "s1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
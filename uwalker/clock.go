@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// clock is the time source of the conductor, the tests drive a simulated one
+type clock interface {
+	Now() time.Time
+	// AfterFunc calls f once the duration elapses
+	AfterFunc(d time.Duration, f func()) timer
+	// After is asked for by Transmit only while it waits for the requests, the simulated clock takes it as the idle notification
+	After(d time.Duration) <-chan time.Time
+}
+
+// timer is the part of time.Timer used by the conductor
+type timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
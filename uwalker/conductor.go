@@ -1,14 +1,24 @@
 package main
 
 import (
+	"container/list"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
+	"uwalker/banner"
+	"uwalker/gen"
 	"uwalker/scan"
 )
 
 const timeout = 20 * time.Second
 
+// retryPoll is how often the SYNs due to be resent are looked for while no targets are left
+const retryPoll = 10 * time.Millisecond
+
+// maxResponse limits the beginning of the first response kept with the result
+const maxResponse = 256
+
 type connectionKey struct {
 	ip   string
 	port uint16
@@ -18,13 +28,33 @@ type Protocol struct {
 	Ip   net.IP
 	Port uint16
 
-	Proto string
+	banner.Result
 }
 
+// ConnectionState recognizes a protocol over an established connection.
+// Read is given the received bytes not consumed yet. It returns the data to send, the number of consumed bytes,
+// the number of bytes it needs in addition to the given ones to go on and the result once the protocol is detected.
+// A response with nothing to send, nothing consumed and nothing needed rejects the protocol.
 type ConnectionState interface {
-	Proto() string
 	Init() []byte
-	Read(data []byte) ([]byte, int, bool)
+	Read(data []byte) ([]byte, int, int, *banner.Result)
+}
+
+// Detector creates a fresh state for a new connection
+type Detector func() ConnectionState
+
+// Detectors maps ports to the ordered lists of detectors tried on them.
+// Default is used for the ports without own detectors.
+type Detectors struct {
+	Default []Detector
+	Ports   map[uint16][]Detector
+}
+
+func (d Detectors) For(port uint16) []Detector {
+	if ds, ok := d.Ports[port]; ok {
+		return ds
+	}
+	return d.Default
 }
 
 type Prober interface {
@@ -40,24 +70,54 @@ type Sender interface {
 	Prober
 	Terminator
 }
+
+// Bounded is implemented by the senders keeping a limited number of probes in flight on their own
+type Bounded interface {
+	// Busy tells whether the next Probe would fail for lack of room
+	Busy() bool
+}
+
 type Limiter interface {
 	Limit(nowNanos int64) bool
 }
 
 type connection struct {
-	seq          uint32 // our sequence
-	unacked      []byte // bytes that are currently not acknowledged by the second party
-	partyNextSeq uint32
+	addr    net.IP
+	port    uint16
+	seq     uint32 // our sequence
+	unacked []byte // bytes that are currently not acknowledged by the second party
+	// in keeps the bytes of the party until the state consumes them, want is how many it waits for
+	in   stream
+	want int
 
 	lstPacket time.Time
 	state     ConnectionState
-
-	cancelTimer *time.Timer
+	// detector is the index of the state's detector for the port
+	detector int
+	detected bool
+	// initiated is when the first request was sent, response is the beginning of the first response
+	initiated time.Time
+	response  []byte
+	rtt       time.Duration
+
+	cancelTimer timer
+	// elem is the element of the connection in the lru list of the conductor
+	elem *list.Element
+
+	// the unacked bytes are resent at rtoAt unless it's zero, rto doubles after every retransmission
+	rto             time.Duration
+	rtoAt           time.Time
+	rtoTimer        timer
+	retransmissions int
+	dupAcks         int
+	// synRetries is how many times the SYN was resent, resent tells whether any data was
+	synRetries int
+	resent     bool
 }
 
 func (c *connection) ack(count int) {
-	if count <= 0 {
-		return // nothing new acked
+	if count <= 0 || count > len(c.unacked) {
+		return // nothing new acked or more than sent
 	}
 	rem := len(c.unacked)
 	newLen := rem - count
@@ -72,35 +132,69 @@ func (c *connection) ack(count int) {
 }
 
 type Conductor struct {
-	ports []uint16
+	// stats is the first to keep the atomic counters aligned on 32-bit platforms
+	stats Stats
 
 	timeouts chan connectionKey
+	rtos     chan connectionKey
+
+	s     Sender
+	l     Limiter
+	clock clock
 
-	s Sender
-	l Limiter
+	connections map[connectionKey]*connection
+	// lru orders the connections from the most recently active to the oldest idle one,
+	// maxInFlight bounds the open connections and the SYNs awaiting an answer, zero is no bound
+	lru         *list.List
+	maxInFlight int
+	detectors   Detectors
+	// retries keeps the detectors to try next on connections reopened after a rejection
+	retries map[connectionKey]retry
 
-	connections  map[connectionKey]*connection
-	stateBuilder func() ConnectionState
+	recovery Recovery
+	// probes keeps the SYNs awaiting an answer, even if they are not resent, to bound them by maxInFlight
+	probes *probes
 
 	txQ chan *txReq
+	// held keeps the SYNs of the reopened connections while the sender is busy, Transmit sends them first
+	held []*txReq
+	// transmitted and collected are closed when Transmit and Collect are finished respectively
+	transmitted chan struct{}
+	collected   chan struct{}
+}
+
+type retry struct {
+	detector int
+	at       time.Time
 }
 
 func NewConductor(
-	ports []uint16,
 	s Sender,
 	l Limiter,
-	stateBuilder func() ConnectionState,
+	detectors Detectors,
+	recovery Recovery,
+	maxInFlight int,
 ) *Conductor {
 
-	return &Conductor{
-		ports:        ports,
-		s:            s,
-		l:            l,
-		stateBuilder: stateBuilder,
+	c := &Conductor{
+		s:         s,
+		l:         l,
+		detectors: detectors,
+		recovery:  recovery,
+		clock:     realClock{},
 
 		connections: make(map[connectionKey]*connection),
+		lru:         list.New(),
+		maxInFlight: maxInFlight,
+		retries:     make(map[connectionKey]retry),
+		timeouts:    make(chan connectionKey),
+		rtos:        make(chan connectionKey),
 		txQ:         make(chan *txReq),
+		transmitted: make(chan struct{}),
+		collected:   make(chan struct{}),
 	}
+	c.probes = newProbes(recovery)
+	return c
 }
 
 type txReq struct {
@@ -109,68 +203,104 @@ type txReq struct {
 	ack  uint32
 
 	term bool
+	syn  bool
 
 	addr net.IP
 	port uint16
 }
 
-func (c *Conductor) Transmit(ips <-chan net.IP) error {
-	inits := make(chan struct {
-		net.IP
-		uint16
-	})
-	go func() {
-		defer close(inits)
-		for ip := range ips {
-			for _, port := range c.ports {
-				inits <- struct {
-					net.IP
-					uint16
-				}{ip, port}
-			}
-		}
-	}()
+// Transmit probes the targets and sends the data of the established connections
+func (c *Conductor) Transmit(targets <-chan gen.Target) error {
+	defer close(c.transmitted)
 	defer log.Println("transmitting routine stopped")
 loop:
 	for {
+		c.resend(c.clock.Now())
 		select { // prioritize connections handling over connection init
 		case req := <-c.txQ:
-			c.send(func() error {
-				if req.term {
-					return c.s.Terminate(req.addr, req.port, req.seq)
-				}
-				return c.s.ProbeData(req.addr, req.port, req.seq, req.ack, req.data)
-			})
+			c.transmit(req)
 			continue
 		default:
 		}
+		if c.paused() {
+			c.wait() // the new SYNs are paused until the table and the sender have room
+			continue
+		}
 		select {
-		case req, ok := <-inits:
+		case t, ok := <-targets:
 			if !ok {
 				break loop
 			}
+			// registered first, the answer may outrun the return of Probe
+			c.probes.sent(t.IP, t.Port, c.clock.Now())
 			c.send(func() error {
-				return c.s.Probe(req.IP, req.uint16)
+				return c.s.Probe(t.IP, t.Port)
 			})
 			continue
 		default:
 		}
 	}
+	idle := c.clock.Now()
 	for { // waiting for remaining tcp connections
 		select {
 		case req := <-c.txQ:
-			c.send(func() error {
-				return c.s.ProbeData(req.addr, req.port, req.seq, req.ack, req.data)
-			})
-		case <-time.After(10 * time.Second):
-			return nil
+			c.transmit(req)
+			idle = c.clock.Now()
+		case now := <-c.clock.After(retryPoll):
+			c.resend(now)
+			if len(c.held) > 0 {
+				idle = now
+			}
+			if now.Sub(idle) > 10*time.Second {
+				return nil
+			}
+		}
+	}
+}
+
+// resend sends the held SYNs once the sender has room and the SYNs due to be resent
+func (c *Conductor) resend(now time.Time) {
+	for len(c.held) > 0 && !c.busy() {
+		req := c.held[0]
+		c.held = c.held[1:]
+		c.transmit(req)
+	}
+	for pr := c.probes.next(now); pr != nil; pr = c.probes.next(now) {
+		atomic.AddUint64(&c.stats.SynRetries, 1)
+		c.send(func() error {
+			return c.s.Probe(pr.addr, pr.key.port)
+		})
+	}
+}
+
+func (c *Conductor) transmit(req *txReq) {
+	if req.syn && c.busy() {
+		c.held = append(c.held, req)
+		return
+	}
+	c.send(func() error {
+		if req.term {
+			return c.s.Terminate(req.addr, req.port, req.seq)
+		}
+		if req.syn {
+			c.probes.sent(req.addr, req.port, c.clock.Now())
+			return c.s.Probe(req.addr, req.port)
 		}
+		return c.s.ProbeData(req.addr, req.port, req.seq, req.ack, req.data)
+	})
+}
+
+// enqueue passes the request to the transmitting routine, requests are dropped once it is stopped
+func (c *Conductor) enqueue(req *txReq) {
+	select {
+	case c.txQ <- req:
+	case <-c.transmitted:
 	}
 }
 
 func (c *Conductor) send(sender func() error) {
 	for {
-		if c.l.Limit(time.Now().UnixNano()) {
+		if c.l.Limit(c.clock.Now().UnixNano()) {
 			if err := sender(); err != nil {
 				log.Println(err)
 				time.Sleep(100 * time.Millisecond)
@@ -181,52 +311,104 @@ func (c *Conductor) send(sender func() error) {
 }
 
 func (c *Conductor) terminate(ip net.IP, seq uint32, k connectionKey) {
-	delete(c.connections, k)
-	c.txQ <- &txReq{seq: seq, term: true, addr: ip, port: k.port}
+	conn := c.remove(k)
+	c.enqueue(&txReq{seq: seq, term: true, addr: ip, port: k.port})
+	if conn == nil || conn.detected {
+		return
+	}
+	next := conn.detector + 1
+	if next >= len(c.detectors.For(k.port)) {
+		return
+	}
+	// the protocol is rejected, the next detector gets a fresh connection
+	c.retries[k] = retry{next, c.clock.Now()}
+	c.schedule(k)
+	c.enqueue(&txReq{syn: true, addr: ip, port: k.port})
+}
+
+// schedule delivers the key to the timeouts channel after the timeout
+func (c *Conductor) schedule(k connectionKey) timer {
+	return c.after(timeout, c.timeouts, k)
 }
 
-func (c *Conductor) newConnection(k connectionKey, partySeq uint32) *connection {
+// after delivers the key to the channel after the duration unless Collect is finished
+func (c *Conductor) after(d time.Duration, ch chan<- connectionKey, k connectionKey) timer {
+	return c.clock.AfterFunc(d, func() {
+		select {
+		case ch <- k:
+		case <-c.collected:
+		}
+	})
+}
+
+func (c *Conductor) newConnection(k connectionKey, p *scan.Packet) *connection {
+	detector := 0
+	if r, ok := c.retries[k]; ok {
+		detector = r.detector
+		delete(c.retries, k)
+	}
+	synRetries := c.probes.answered(k)
+	c.makeRoom()
 	conn := &connection{
-		0,
-		nil,
-		partySeq,
-		time.Now(),
-		c.stateBuilder(),
-		time.AfterFunc(timeout, func() {
-			c.timeouts <- k
-		}),
+		addr:        p.Addr,
+		port:        k.port,
+		seq:         0,
+		in:          stream{next: p.Seq},
+		lstPacket:   c.clock.Now(),
+		state:       c.detectors.For(k.port)[detector](),
+		detector:    detector,
+		cancelTimer: c.schedule(k),
+		rto:         c.recovery.RTO,
+		synRetries:  synRetries,
 	}
 	c.connections[k] = conn
+	conn.elem = c.lru.PushFront(conn)
+	atomic.AddUint64(&c.stats.Open, 1)
 	return conn
 }
 
-func (c *Conductor) Collect(packets <-chan *scan.Packet) <-chan Protocol {
+// Collect handles the batches of the received packets
+func (c *Conductor) Collect(packets <-chan []*scan.Packet) <-chan Protocol {
 	established := make(chan Protocol)
 	go func() {
-		c.timeouts = make(chan connectionKey)
-		defer close(c.timeouts)
+		defer close(c.collected)
 		defer close(established)
+		defer func() {
+			st := c.Stats()
+			log.Printf("collecting routine stopped: %d protocols detected, %d after SYN retries, %d after retransmissions; %d SYNs and %d segments resent, %d connections evicted",
+				st.Hits, st.SynRetryHits, st.RetransmitHits, st.SynRetries, st.Retransmissions, st.Evicted)
+		}()
 	loop:
 		for {
 			select {
-			case p, more := <-packets:
+			case batch, more := <-packets:
 				if !more {
 					break loop
 				}
-				k := connectionKey{
-					p.Addr.String(),
-					p.Port,
+				for _, p := range batch {
+					k := connectionKey{
+						p.Addr.String(),
+						p.Port,
+					}
+					conn := c.connections[k]
+					res, ok := c.handle(p, k, conn, established)
+					if !ok {
+						c.terminate(p.Addr, p.Ack, k)
+						continue
+					}
+					if res != nil {
+						c.enqueue(res)
+					}
 				}
+			case k := <-c.rtos:
+				c.expire(k)
+			case k := <-c.timeouts:
 				conn := c.connections[k]
-				res := c.handle(p, k, conn, established)
-				if res == nil {
-					c.terminate(p.Addr, p.Ack, k)
+				if r, ok := c.retries[k]; ok && conn == nil && !r.at.Add(timeout).After(c.clock.Now()) {
+					delete(c.retries, k) // the reopened connection is not accepted
 					continue
 				}
-				c.txQ <- res
-			case k := <-c.timeouts:
-				conn := c.connections[k]
-				if conn != nil && !conn.lstPacket.Add(timeout).After(time.Now()) {
+				if conn != nil && !conn.lstPacket.Add(timeout).After(c.clock.Now()) {
 					log.Printf("closed by timeout %s:%d", k.ip, k.port)
 					c.terminate(net.ParseIP(k.ip), conn.seq, k)
 				}
@@ -236,67 +418,186 @@ func (c *Conductor) Collect(packets <-chan *scan.Packet) <-chan Protocol {
 	return established
 }
 
-func (c *Conductor) handle(p *scan.Packet, k connectionKey, conn *connection, established chan<- Protocol) *txReq {
+// handle returns the reply to the packet if there is any, the connection is terminated if it's not ok
+func (c *Conductor) handle(p *scan.Packet, k connectionKey, conn *connection, established chan<- Protocol) (*txReq, bool) {
 	if p.Done {
-		return nil
+		c.probes.answered(k)
+		return nil, false
 	}
 	if conn == nil && !p.Start {
-		return nil // Connection state lost or deleted
+		return nil, false // Connection state lost or deleted
+	}
+	if conn == nil && len(c.detectors.For(k.port)) == 0 {
+		return nil, false
 	}
 	if conn == nil {
-		conn = c.newConnection(k, p.Seq)
+		conn = c.newConnection(k, p)
 	} else {
-		if p.Start { // duplicate syn-ack
-			return conn.toRes(p)
+		if p.Start { // duplicate syn-ack, our ack with the data is lost
+			if len(conn.unacked) == 0 {
+				return conn.toRes(), true
+			}
+			return c.retransmit(conn), true
 		}
-		conn.lstPacket = time.Now()
+		conn.lstPacket = c.clock.Now()
+		c.lru.MoveToFront(conn.elem)
 	}
 	conn.cancelTimer.Reset(timeout)
-	return conn.handle(p, established)
+	if conn.dupAck(p) {
+		if conn.dupAcks < dupAcks {
+			return nil, true
+		}
+		conn.dupAcks = 0
+		return c.retransmit(conn), true
+	}
+	res, ok := conn.handle(p, c.clock.Now(), established)
+	if conn.detected {
+		c.hit(conn)
+	}
+	if ok {
+		c.armRTO(k, conn)
+	}
+	return res, ok
+}
+
+// retransmit resends the unacked bytes
+func (c *Conductor) retransmit(conn *connection) *txReq {
+	atomic.AddUint64(&c.stats.Retransmissions, 1)
+	conn.resent = true
+	return conn.toRes()
 }
 
-func (c *connection) handle(p *scan.Packet, established chan<- Protocol) *txReq {
-	acked := p.Ack - c.seq
-	c.ack(int(acked))
-	if c.partyNextSeq < p.Seq {
-		log.Printf("Reordering detected for %s:%d", p.Addr.String(), p.Port)
-		return c.toRes(p)
+// armRTO schedules the retransmission of the unacked bytes unless it's scheduled already
+func (c *Conductor) armRTO(k connectionKey, conn *connection) {
+	if len(conn.unacked) == 0 || c.recovery.Retransmissions == 0 {
+		conn.rtoAt = time.Time{}
+		return
+	}
+	if !conn.rtoAt.IsZero() {
+		return
+	}
+	conn.rtoAt = c.clock.Now().Add(conn.rto)
+	if conn.rtoTimer == nil {
+		conn.rtoTimer = c.after(conn.rto, c.rtos, k)
+	} else {
+		conn.rtoTimer.Reset(conn.rto)
 	}
-	if c.partyNextSeq > p.Seq {
-		log.Printf("Unexpected party seq for %s:%d. Killing the connection", p.Addr.String(), p.Port)
-		return nil
+}
+
+// expire retransmits the unacked bytes of the connection once its RTO expires
+func (c *Conductor) expire(k connectionKey) {
+	conn := c.connections[k]
+	if conn == nil || conn.rtoAt.IsZero() || c.clock.Now().Before(conn.rtoAt) {
+		return // acked meanwhile or rescheduled
 	}
-	var res []byte
-	var read int
-	var finished bool
+	conn.rtoAt = time.Time{}
+	if conn.retransmissions >= c.recovery.Retransmissions {
+		log.Printf("closed after %d retransmissions %s:%d", conn.retransmissions, k.ip, k.port)
+		c.terminate(conn.addr, conn.seq, k)
+		return
+	}
+	conn.retransmissions++
+	conn.rto *= 2
+	c.enqueue(c.retransmit(conn))
+	c.armRTO(k, conn)
+}
+
+func (c *Conductor) hit(conn *connection) {
+	atomic.AddUint64(&c.stats.Hits, 1)
+	if conn.synRetries > 0 {
+		atomic.AddUint64(&c.stats.SynRetryHits, 1)
+	}
+	if conn.resent {
+		atomic.AddUint64(&c.stats.RetransmitHits, 1)
+	}
+}
+
+// Stats returns the counters of the detected protocols, the resent packets and the occupancy of the connection table
+func (c *Conductor) Stats() Stats {
+	return Stats{
+		Hits:            atomic.LoadUint64(&c.stats.Hits),
+		SynRetryHits:    atomic.LoadUint64(&c.stats.SynRetryHits),
+		RetransmitHits:  atomic.LoadUint64(&c.stats.RetransmitHits),
+		SynRetries:      atomic.LoadUint64(&c.stats.SynRetries),
+		Retransmissions: atomic.LoadUint64(&c.stats.Retransmissions),
+		Open:            atomic.LoadUint64(&c.stats.Open),
+		HalfOpen:        uint64(c.probes.len()),
+		Evicted:         atomic.LoadUint64(&c.stats.Evicted),
+	}
+}
+
+// dupAck tells whether the packet is a duplicate ACK of the unacked bytes and counts it
+func (c *connection) dupAck(p *scan.Packet) bool {
+	if p.Start || len(p.Data) > 0 || len(c.unacked) == 0 || p.Ack != c.seq {
+		return false
+	}
+	c.dupAcks++
+	return true
+}
+
+func (c *connection) handle(p *scan.Packet, now time.Time, established chan<- Protocol) (*txReq, bool) {
 	if p.Start {
-		res = c.state.Init()
-	} else if p.Data != nil {
-		res, read, finished = c.state.Read(p.Data)
-		if finished {
-			established <- Protocol{p.Addr, p.Port, c.state.Proto()}
-			return nil
+		c.seq = p.Ack         // the SYN takes a sequence number
+		c.in.next = p.Seq + 1 // and so does the SYN of the party
+		c.unacked = append(c.unacked, c.state.Init()...)
+		c.initiated = now
+		return c.toRes(), true
+	}
+	if acked := int32(p.Ack - c.seq); acked > 0 && int(acked) <= len(c.unacked) {
+		c.ack(int(acked))
+		c.dupAcks = 0
+		c.rtoAt = time.Time{} // restarted for the rest
+	}
+	if len(p.Data) == 0 {
+		return nil, true // a pure ACK needs no answer
+	}
+	before := len(c.in.buf)
+	grew, ok := c.in.add(p.Seq, p.Data)
+	if !ok {
+		return nil, false // the state waits for more than is kept
+	}
+	if !grew {
+		return c.toRes(), true // received already or after a gap, the ack is repeated
+	}
+	if c.response == nil {
+		c.rtt = now.Sub(c.initiated)
+		if est := 3 * c.rtt; est >= minRTO && est < c.rto {
+			c.rto = est
 		}
-		if res == nil && read == 0 {
-			return nil
+	}
+	if n := maxResponse - len(c.response); n > 0 {
+		if received := c.in.buf[before:]; len(received) < n {
+			n = len(received)
 		}
+		c.response = append(c.response, c.in.buf[before:before+n]...)
 	}
-	c.unacked = append(c.unacked, res...)
-
-	if p.Start {
-		read++ // syn contributes to the sequence
+	for len(c.in.buf) > 0 && len(c.in.buf) >= c.want {
+		res, read, need, result := c.state.Read(c.in.buf)
+		if result != nil {
+			c.detected = true
+			result.Response = c.response
+			result.RTT = c.rtt
+			established <- Protocol{p.Addr, p.Port, *result}
+			return nil, false
+		}
+		if res == nil && read == 0 && need == 0 {
+			return nil, false
+		}
+		c.unacked = append(c.unacked, res...)
+		c.in.consume(read)
+		if c.want = len(c.in.buf) + need; read == 0 && need == 0 {
+			c.want++ // nothing consumed, the same bytes are not read again
+		}
 	}
-	toAck := p.Seq + uint32(read)
-	c.partyNextSeq = toAck
-	return c.toRes(p)
+	return c.toRes(), true
 }
 
-func (c *connection) toRes(p *scan.Packet) *txReq {
+func (c *connection) toRes() *txReq {
 	return &txReq{
 		data: c.unacked,
-		addr: p.Addr,
-		port: p.Port,
-		ack:  c.partyNextSeq,
+		addr: c.addr,
+		port: c.port,
+		ack:  c.in.next,
 		seq:  c.seq,
 		term: false,
 	}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"uwalker/banner"
+	"uwalker/gen"
+	"uwalker/scan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sent struct {
+	op   string
+	seq  uint32
+	data []byte
+}
+
+// fakeSender records the packets sent by the conductor
+type fakeSender struct {
+	sent chan sent
+}
+
+func (f *fakeSender) Probe(dst net.IP, port uint16) error {
+	f.sent <- sent{op: "syn"}
+	return nil
+}
+
+func (f *fakeSender) ProbeData(dst net.IP, port uint16, seq, ack uint32, data []byte) error {
+	f.sent <- sent{op: "data", seq: seq, data: data}
+	return nil
+}
+
+func (f *fakeSender) Terminate(dst net.IP, port uint16, seq uint32) error {
+	f.sent <- sent{op: "rst", seq: seq}
+	return nil
+}
+
+// fakeState expects the reply to its greeting
+type fakeState struct {
+	proto    string
+	greeting string
+	reply    string
+}
+
+func (s *fakeState) Init() []byte { return []byte(s.greeting) }
+
+func (s *fakeState) Read(data []byte) ([]byte, int, int, *banner.Result) {
+	if string(data) == s.reply {
+		return nil, len(data), 0, &banner.Result{Proto: s.proto}
+	}
+	return nil, 0, 0, nil
+}
+
+func detector(proto, greeting, reply string) Detector {
+	return func() ConnectionState {
+		return &fakeState{proto, greeting, reply}
+	}
+}
+
+func next(t *testing.T, s *fakeSender) sent {
+	select {
+	case p := <-s.sent:
+		return p
+	case <-time.After(time.Second):
+		require.FailNow(t, "nothing is sent")
+		return sent{}
+	}
+}
+
+func TestConductor_nextDetector(t *testing.T) {
+	s := &fakeSender{sent: make(chan sent, 10)}
+	c := NewConductor(s, noLimit{}, Detectors{
+		Default: []Detector{detector("a", "hi a", "ok a"), detector("b", "hi b", "ok b")},
+	}, Recovery{}, 0)
+	packets := make(chan []*scan.Packet)
+	established := c.Collect(packets)
+	targets := make(chan gen.Target, 1)
+	targets <- gen.Target{IP: net.IPv4(10, 0, 0, 1), Port: 1080}
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+	ip := net.IPv4(10, 0, 0, 1)
+
+	assert.Equal(t, "syn", next(t, s).op)
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Start: true, Seq: 100, Ack: 0}}
+	assert.Equal(t, sent{op: "data", data: []byte("hi a")}, next(t, s))
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Seq: 101, Ack: 4, Data: []byte("ok b")}}
+	// a rejects the reply, the connection is reopened for b
+	assert.Equal(t, sent{op: "rst", seq: 4}, next(t, s))
+	assert.Equal(t, "syn", next(t, s).op)
+
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Start: true, Seq: 500, Ack: 0}}
+	assert.Equal(t, sent{op: "data", data: []byte("hi b")}, next(t, s))
+	go func() {
+		packets <- []*scan.Packet{{Addr: ip, Port: 1080, Seq: 501, Ack: 4, Data: []byte("ok b")}}
+	}()
+	select {
+	case p := <-established:
+		assert.Equal(t, "b", p.Proto)
+		assert.Equal(t, uint16(1080), p.Port)
+		assert.Equal(t, []byte("ok b"), p.Response)
+		assert.NotZero(t, p.RTT)
+	case <-time.After(time.Second):
+		require.FailNow(t, "protocol is not detected")
+	}
+	// detected connections are not reopened
+	assert.Equal(t, sent{op: "rst", seq: 4}, next(t, s))
+	close(packets)
+	select {
+	case p := <-s.sent:
+		assert.Fail(t, "unexpected packet", "%v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConductor_portDetectors(t *testing.T) {
+	s := &fakeSender{sent: make(chan sent, 10)}
+	c := NewConductor(s, noLimit{}, Detectors{
+		Default: []Detector{detector("a", "hi a", "ok a")},
+		Ports:   map[uint16][]Detector{3128: {detector("b", "hi b", "ok b")}},
+	}, Recovery{}, 0)
+	packets := make(chan []*scan.Packet)
+	c.Collect(packets)
+	targets := make(chan gen.Target)
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+	ip := net.IPv4(10, 0, 0, 1)
+
+	// the whole exchange arrives in a single batch
+	packets <- []*scan.Packet{
+		{Addr: ip, Port: 3128, Start: true, Seq: 100},
+		{Addr: ip, Port: 3128, Seq: 101, Ack: 4, Data: []byte("ok a")},
+	}
+	assert.Equal(t, sent{op: "data", data: []byte("hi b")}, next(t, s))
+	// the last detector of the port rejects, nothing to retry
+	assert.Equal(t, sent{op: "rst", seq: 4}, next(t, s))
+	close(packets)
+	select {
+	case p := <-s.sent:
+		assert.Fail(t, "unexpected packet", "%v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_parseDetectors(t *testing.T) {
+	d, err := parseDetectors("example.com:80", "socks5", map[string]string{"3128": "socks4, socks5"})
+	require.NoError(t, err)
+	assert.Len(t, d.For(1080), 1)
+	assert.Len(t, d.For(3128), 2)
+
+	_, err = parseDetectors("example.com:80", "gopher", nil)
+	assert.Error(t, err)
+	_, err = parseDetectors("example.com:80", "socks5", map[string]string{"http": "socks5"})
+	assert.Error(t, err)
+	_, err = parseDetectors("example.com", "socks5", nil)
+	assert.Error(t, err)
+}
+
+func TestConductor_connector(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 5)
+				if _, err := io.ReadFull(conn, greeting); err == nil {
+					_, _ = conn.Write([]byte{5, 2})
+				}
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+
+	b := scan.NewConnector(4, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewConductor(b, noLimit{}, Detectors{Default: []Detector{func() ConnectionState { return &banner.Socks5{} }}},
+		Recovery{Retransmissions: 3, RTO: time.Second}, 0)
+	established := c.Collect(b.Packets(ctx))
+	targets := make(chan gen.Target, 1)
+	targets <- gen.Target{IP: addr.IP, Port: uint16(addr.Port)}
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+
+	select {
+	case p := <-established:
+		assert.Equal(t, "socks5", p.Proto)
+		assert.Equal(t, []string{"password"}, p.Auth)
+		assert.Equal(t, []byte{5, 2}, p.Response)
+	case <-time.After(time.Second):
+		require.FailNow(t, "protocol is not detected")
+	}
+}
+
+func TestConductor_reassembly(t *testing.T) {
+	s := &fakeSender{sent: make(chan sent, 10)}
+	c := NewConductor(s, noLimit{}, Detectors{
+		Default: []Detector{func() ConnectionState { return &banner.HTTPProxy{Host: "example.com", Port: 80} }},
+	}, Recovery{}, 0)
+	packets := make(chan []*scan.Packet)
+	established := c.Collect(packets)
+	targets := make(chan gen.Target)
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+	ip := net.IPv4(10, 0, 0, 1)
+
+	packets <- []*scan.Packet{{Addr: ip, Port: 3128, Start: true, Seq: 100, Ack: 1}}
+	req := next(t, s)
+	require.Equal(t, "data", req.op)
+	acked := 1 + uint32(len(req.data))
+
+	// the headers arrive in three segments, the second one first
+	packets <- []*scan.Packet{{Addr: ip, Port: 3128, Seq: 110, Ack: acked, Data: []byte("200 Connection ")}}
+	assert.Equal(t, sent{op: "data", seq: acked}, next(t, s))
+	packets <- []*scan.Packet{{Addr: ip, Port: 3128, Seq: 101, Ack: acked, Data: []byte("HTTP/1.1 ")}}
+	assert.Equal(t, sent{op: "data", seq: acked}, next(t, s))
+	go func() {
+		packets <- []*scan.Packet{{Addr: ip, Port: 3128, Seq: 125, Ack: acked, Data: []byte("established\r\n\r\n")}}
+	}()
+	select {
+	case p := <-established:
+		assert.Equal(t, "http", p.Proto)
+		assert.Equal(t, "HTTP/1.1 200 Connection established\r\n\r\n", string(p.Response))
+	case <-time.After(time.Second):
+		require.FailNow(t, "protocol is not detected")
+	}
+	assert.Equal(t, sent{op: "rst", seq: acked}, next(t, s))
+	close(packets)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+	"uwalker/banner"
+)
+
+// newRegistry returns detectors of the supported protocols by name.
+// testHost is the destination requested from proxies by the detectors that need one.
+func newRegistry(testHost string) (map[string]Detector, error) {
+	host, p, err := net.SplitHostPort(testHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid test host")
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("invalid test host port %s", p)
+	}
+	return map[string]Detector{
+		"socks5": func() ConnectionState { return &banner.Socks5{} },
+		"socks4": func() ConnectionState { return &banner.Socks4{Host: host, Port: uint16(port)} },
+		"http":   func() ConnectionState { return &banner.HTTPProxy{Host: host, Port: uint16(port)} },
+		"http-get": func() ConnectionState {
+			return &banner.HTTPProxy{Host: host, Port: uint16(port), Get: true}
+		},
+	}, nil
+}
+
+func parseProtocols(registry map[string]Detector, p string) ([]Detector, error) {
+	var res []Detector
+	for _, name := range strings.Split(p, ",") {
+		name = strings.TrimSpace(name)
+		d, ok := registry[name]
+		if !ok {
+			return nil, errors.Errorf("unknown protocol %s", name)
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// parseDetectors builds detectors from the default protocols and the protocols overridden for ports
+func parseDetectors(testHost, protocols string, portProtocols map[string]string) (Detectors, error) {
+	registry, err := newRegistry(testHost)
+	if err != nil {
+		return Detectors{}, err
+	}
+	def, err := parseProtocols(registry, protocols)
+	if err != nil {
+		return Detectors{}, err
+	}
+	res := Detectors{Default: def, Ports: make(map[uint16][]Detector)}
+	for p, protocols := range portProtocols {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return Detectors{}, errors.Errorf("invalid port %s format", p)
+		}
+		ds, err := parseProtocols(registry, protocols)
+		if err != nil {
+			return Detectors{}, errors.Wrapf(err, "invalid protocols of the port %s", p)
+		}
+		res.Ports[uint16(port)] = ds
+	}
+	return res, nil
+}
@@ -0,0 +1,156 @@
+// Package firewall keeps the kernel from resetting the connections opened by the raw probes.
+// The kernel knows nothing of them and answers every SYN-ACK to the source ports with a RST.
+package firewall
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// output executes the command and returns its output, the tests replace it
+var output = func(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func run(name string, args ...string) error {
+	_, err := output(name, args...)
+	return err
+}
+
+var lookPath = exec.LookPath
+
+// tag is the prefix of the comments of the iptables rules and the names of the nft tables of all walkers
+const tag = "uwalker"
+
+// newID identifies the rules of the process, so walkers with the same ports don't remove the rules of each other
+var newID = func() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%d_%s", os.Getpid(), hex.EncodeToString(b[:]))
+}
+
+// DropInput installs the rules dropping the incoming TCP segments to the ports from first to last
+// with iptables or, if it's not available, nftables. The returned function removes the rules.
+// The IPv6 rule of iptables is best effort, the walker scans IPv4 without ip6tables.
+func DropInput(first, last uint16) (func() error, error) {
+	id := newID()
+	if _, err := lookPath("iptables"); err == nil {
+		return dropIptables(id, first, last)
+	}
+	if _, err := lookPath("nft"); err == nil {
+		return dropNft(id, first, last)
+	}
+	return nil, errors.New("neither iptables nor nft is found")
+}
+
+func dropIptables(id string, first, last uint16) (func() error, error) {
+	rule := []string{"INPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d:%d", first, last),
+		"-m", "comment", "--comment", tag + "_" + id, "-j", "DROP"}
+	var installed []string
+	remove := func() error {
+		var res error
+		for _, cmd := range installed {
+			if err := run(cmd, append([]string{"-D"}, rule...)...); err != nil && res == nil {
+				res = err
+			}
+		}
+		return res
+	}
+	if err := run("iptables", append([]string{"-I"}, rule...)...); err != nil {
+		return nil, err
+	}
+	installed = append(installed, "iptables")
+	if _, err := lookPath("ip6tables"); err != nil {
+		log.Printf("the replies to IPv6 probes are not dropped: %v", err)
+		return remove, nil
+	}
+	if err := run("ip6tables", append([]string{"-I"}, rule...)...); err != nil {
+		log.Printf("the replies to IPv6 probes are not dropped: %v", err)
+		return remove, nil
+	}
+	installed = append(installed, "ip6tables")
+	return remove, nil
+}
+
+func dropNft(id string, first, last uint16) (func() error, error) {
+	// the inet table covers both IPv4 and IPv6, a table per process lets walkers share the host
+	table := "inet " + tag + "_" + id
+	remove := func() error {
+		return run("nft", "delete table "+table)
+	}
+	for _, cmd := range []string{
+		"add table " + table,
+		"add chain " + table + " input { type filter hook input priority 0 ; }",
+		fmt.Sprintf("add rule %s input tcp dport %d-%d drop", table, first, last),
+	} {
+		if err := run("nft", cmd); err != nil {
+			_ = remove()
+			return nil, err
+		}
+	}
+	return remove, nil
+}
+
+// tagged tells if the rule is commented by a walker, the older walkers commented the rules with the bare tag
+func tagged(args []string) bool {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--comment" {
+			c := strings.Trim(args[i+1], `"`)
+			return c == tag || strings.HasPrefix(c, tag+"_")
+		}
+	}
+	return false
+}
+
+// RemoveStale removes the rules of all walkers, including the running ones.
+// It cleans up after the walkers that didn't exit cleanly and returns the number of the removed rules.
+func RemoveStale() (int, error) {
+	removed := 0
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if _, err := lookPath(cmd); err != nil {
+			continue
+		}
+		rules, err := output(cmd, "-S", "INPUT")
+		if err != nil {
+			return removed, err
+		}
+		for _, rule := range strings.Split(rules, "\n") {
+			args := strings.Fields(rule)
+			if len(args) < 2 || args[0] != "-A" || !tagged(args) {
+				continue
+			}
+			if err := run(cmd, append([]string{"-D"}, args[1:]...)...); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	if _, err := lookPath("nft"); err != nil {
+		return removed, nil
+	}
+	tables, err := output("nft", "list", "tables")
+	if err != nil {
+		return removed, err
+	}
+	for _, line := range strings.Split(tables, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 || f[0] != "table" || !strings.HasPrefix(f[2], tag+"_") {
+			continue
+		}
+		if err := run("nft", "delete table "+f[1]+" "+f[2]); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
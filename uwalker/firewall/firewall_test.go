@@ -0,0 +1,118 @@
+package firewall
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCommands records the executed commands, only the available tools are found,
+// the commands starting with a failing prefix fail and the others print the outputs by command
+func fakeCommands(t *testing.T, available []string, outputs map[string]string, failing ...string) *[]string {
+	origOutput, origLookPath, origNewID := output, lookPath, newID
+	t.Cleanup(func() {
+		output, lookPath, newID = origOutput, origLookPath, origNewID
+	})
+	newID = func() string { return "42_cafe" }
+	var cmds []string
+	lookPath = func(file string) (string, error) {
+		for _, a := range available {
+			if a == file {
+				return "/sbin/" + file, nil
+			}
+		}
+		return "", exec.ErrNotFound
+	}
+	output = func(name string, args ...string) (string, error) {
+		cmd := strings.Join(append([]string{name}, args...), " ")
+		cmds = append(cmds, cmd)
+		for _, f := range failing {
+			if strings.HasPrefix(cmd, f) {
+				return "", errors.New("failed")
+			}
+		}
+		return outputs[cmd], nil
+	}
+	return &cmds
+}
+
+func TestDropInput_iptables(t *testing.T) {
+	cmds := fakeCommands(t, []string{"iptables", "ip6tables", "nft"}, nil, "iptables -D", "ip6tables -D")
+	remove, err := DropInput(55000, 55099)
+	require.NoError(t, err)
+	rule := "INPUT -p tcp --dport 55000:55099 -m comment --comment uwalker_42_cafe -j DROP"
+	assert.Equal(t, []string{"iptables -I " + rule, "ip6tables -I " + rule}, *cmds)
+
+	*cmds = nil
+	assert.Error(t, remove()) // the fake fails the deletes
+	assert.Equal(t, []string{"iptables -D " + rule, "ip6tables -D " + rule}, *cmds)
+}
+
+func TestDropInput_iptablesFailure(t *testing.T) {
+	cmds := fakeCommands(t, []string{"iptables", "ip6tables"}, nil, "iptables -I")
+	_, err := DropInput(55324, 55324)
+	require.Error(t, err)
+	assert.Len(t, *cmds, 1)
+}
+
+func TestDropInput_ip6tablesMissing(t *testing.T) {
+	for name, available := range map[string][]string{
+		"missing": {"iptables"},
+		"failing": {"iptables", "ip6tables"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cmds := fakeCommands(t, available, nil, "ip6tables")
+			remove, err := DropInput(55324, 55324)
+			require.NoError(t, err)
+			rule := "INPUT -p tcp --dport 55324:55324 -m comment --comment uwalker_42_cafe -j DROP"
+			*cmds = nil
+			require.NoError(t, remove())
+			// only the IPv4 rule is installed
+			assert.Equal(t, []string{"iptables -D " + rule}, *cmds)
+		})
+	}
+}
+
+func TestDropInput_nft(t *testing.T) {
+	cmds := fakeCommands(t, []string{"nft"}, nil)
+	remove, err := DropInput(55324, 55324)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"nft add table inet uwalker_42_cafe",
+		"nft add chain inet uwalker_42_cafe input { type filter hook input priority 0 ; }",
+		"nft add rule inet uwalker_42_cafe input tcp dport 55324-55324 drop",
+	}, *cmds)
+	*cmds = nil
+	require.NoError(t, remove())
+	assert.Equal(t, []string{"nft delete table inet uwalker_42_cafe"}, *cmds)
+}
+
+func TestDropInput_missing(t *testing.T) {
+	fakeCommands(t, nil, nil)
+	_, err := DropInput(55324, 55324)
+	assert.Error(t, err)
+}
+
+func TestRemoveStale(t *testing.T) {
+	cmds := fakeCommands(t, []string{"iptables", "nft"}, map[string]string{
+		"iptables -S INPUT": "-P INPUT ACCEPT\n" +
+			"-A INPUT -p tcp -m tcp --dport 55324:55324 -m comment --comment uwalker_1_ab -j DROP\n" +
+			"-A INPUT -p tcp -m tcp --dport 22 -m comment --comment ssh -j ACCEPT\n" +
+			"-A INPUT -p tcp -m tcp --dport 55324:55324 -m comment --comment uwalker -j DROP\n",
+		"nft list tables": "table inet filter\ntable inet uwalker_2_cd\n",
+	})
+	removed, err := RemoveStale()
+	require.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	assert.Equal(t, []string{
+		"iptables -S INPUT",
+		"iptables -D INPUT -p tcp -m tcp --dport 55324:55324 -m comment --comment uwalker_1_ab -j DROP",
+		"iptables -D INPUT -p tcp -m tcp --dport 55324:55324 -m comment --comment uwalker -j DROP",
+		"nft list tables",
+		"nft delete table inet uwalker_2_cd",
+	}, *cmds)
+}
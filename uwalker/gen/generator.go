@@ -3,61 +3,192 @@ package gen
 import (
 	"context"
 	"github.com/pkg/errors"
-	"log"
+	"math/bits"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// Generator produces the scanned targets in a pseudo-random order defined by the seed,
+// so probes are spread over all the subnets instead of flooding them one after another.
+// Only the subnets are kept in memory, a target is computed from its index in the permutation.
 type Generator struct {
-	cidrs   []string
+	subnets []*net.IPNet
+	// starts are the indexes of the first addresses of the subnets in the address space of all subnets
+	starts  []uint64
+	size    uint64
 	blacked *sSet
+	seed    uint64
+	// shard is the index of the part of the permutation generated out of shards parts
+	shard, shards uint64
+
+	mu    sync.Mutex
+	start uint64
+	pos   uint64
+}
+
+// Target is an address and a port to probe
+type Target struct {
+	IP   net.IP
+	Port uint16
 }
 
-func NewGenerator(cidrs []string, blacked []string) (*Generator, error) {
+func NewGenerator(cidrs []string, blacked []string, seed uint64) (*Generator, error) {
 	blackedNets := make([]*net.IPNet, len(blacked))
 	for i, b := range blacked {
-		_, n, err := net.ParseCIDR(b)
+		n, err := parseSubnet(b)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to parse CIDR from the blacklist %s", b)
 		}
 		blackedNets[i] = n
 	}
-	return &Generator{
-		cidrs:   cidrs,
+	g := &Generator{
 		blacked: newSSet(blackedNets),
-	}, nil
+		seed:    seed,
+		shards:  1,
+	}
+	for _, cidr := range cidrs {
+		n, err := parseSubnet(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse CIDR %s", cidr)
+		}
+		ones, bits := n.Mask.Size()
+		// IPv6 subnets are meant to be hitlists, sweeping a /64 would never end anyway
+		if bits-ones >= 48 {
+			return nil, errors.Errorf("subnet %s is too large", cidr)
+		}
+		size := uint64(1) << uint(bits-ones)
+		if g.size+size < g.size {
+			return nil, errors.New("too many targets")
+		}
+		g.subnets = append(g.subnets, n)
+		g.starts = append(g.starts, g.size)
+		g.size += size
+	}
+	return g, nil
 }
 
-func (g *Generator) Ips(ctx context.Context) chan net.IP {
-	out := make(chan net.IP)
+// parseSubnet parses a CIDR or a single address of either family
+func parseSubnet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.Errorf("invalid address %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Shard makes the generator produce only the i-th of n disjoint parts of the targets.
+// Generators with the same subnets, blacklist and seed produce every target exactly once together.
+func (g *Generator) Shard(i, n uint64) error {
+	if n == 0 || i >= n {
+		return errors.Errorf("invalid shard %d of %d", i, n)
+	}
+	g.shard, g.shards = i, n
+	return nil
+}
+
+// bounds returns the range of the permutation indexes of the shard
+func (g *Generator) bounds(n uint64) (uint64, uint64) {
+	part := func(i uint64) uint64 {
+		hi, lo := bits.Mul64(n, i)
+		q, _ := bits.Div64(hi, lo, g.shards)
+		return q
+	}
+	return part(g.shard), part(g.shard + 1)
+}
+
+// Resume makes the generator start from the position instead of the first target
+func (g *Generator) Resume(pos uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.start = pos
+	g.pos = pos
+}
+
+// Position returns the index of the last target taken from the generator in the permutation.
+// Resuming from it generates the target again, so no target is skipped.
+func (g *Generator) Position() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pos
+}
+
+// Targets generates every port of every address of the subnets once, skipping the blacklisted addresses
+func (g *Generator) Targets(ctx context.Context, ports []uint16) <-chan Target {
+	out := make(chan Target)
+	g.mu.Lock()
+	start := g.start
+	g.mu.Unlock()
 	go func() {
 		defer close(out)
-		for _, cidr := range g.cidrs {
-			ip, ipnet, err := net.ParseCIDR(cidr)
-			if err != nil {
-				log.Println("Error generating ip: ", err)
+		nports := uint64(len(ports))
+		n := g.size * nports
+		perm := newPermutation(n, g.seed)
+		lo, hi := g.bounds(n)
+		if start < lo {
+			start = lo
+		}
+		for i := start; i < hi; i++ {
+			t := perm.at(i)
+			ip := g.address(t / nports)
+			if g.blacked.contains(ip) {
+				continue
 			}
-			for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-				if g.blacked.contains(ip) {
-					continue
-				}
-				dup := make(net.IP, len(ip))
-				copy(dup, ip)
-				select {
-				case <-ctx.Done():
-					return
-				case out <- dup:
-				}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- Target{ip, ports[t%nports]}:
 			}
+			g.mu.Lock()
+			g.pos = i
+			g.mu.Unlock()
 		}
 	}()
 	return out
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
+// Ips generates every address of the subnets once, skipping the blacklisted ones
+func (g *Generator) Ips(ctx context.Context) chan net.IP {
+	out := make(chan net.IP)
+	go func() {
+		defer close(out)
+		for t := range g.Targets(ctx, []uint16{0}) {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- t.IP:
+			}
 		}
+	}()
+	return out
+}
+
+// address returns the address with the index in the address space of all subnets
+func (g *Generator) address(i uint64) net.IP {
+	k := sort.Search(len(g.starts), func(k int) bool {
+		return g.starts[k] > i
+	}) - 1
+	n := g.subnets[k]
+	ip := make(net.IP, len(n.IP))
+	copy(ip, n.IP)
+	add(ip, i-g.starts[k])
+	return ip
+}
+
+// add increments the ip by n
+func add(ip net.IP, n uint64) {
+	for j := len(ip) - 1; j >= 0 && n > 0; j-- {
+		sum := uint64(ip[j]) + n&0xff
+		ip[j] = byte(sum)
+		n = n>>8 + sum>>8
 	}
 }
@@ -3,7 +3,11 @@ package gen
 import (
 	"context"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGenerator_Ips(t *testing.T) {
@@ -47,7 +51,7 @@ func TestGenerator_Ips(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			g, err := NewGenerator(tt.fields.cidrs, blacklist)
+			g, err := NewGenerator(tt.fields.cidrs, blacklist, 1)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -66,3 +70,163 @@ func chanSz(c chan net.IP) int {
 	}
 	return len(m)
 }
+
+func TestGenerator_Targets(t *testing.T) {
+	g, err := NewGenerator([]string{"10.0.0.0/24", "10.0.2.0/25"}, []string{"10.0.2.0/26"}, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := []uint16{80, 1080, 3128}
+	seen := make(map[string]bool)
+	var prev net.IP
+	adjacent := 0
+	for tg := range g.Targets(context.Background(), ports) {
+		k := tg.IP.String() + ":" + strconv.Itoa(int(tg.Port))
+		if seen[k] {
+			t.Fatalf("target %v is generated twice", tg)
+		}
+		seen[k] = true
+		if tg.IP.Equal(net.ParseIP("10.0.2.1")) {
+			t.Fatalf("blacklisted target %v is generated", tg)
+		}
+		if prev != nil && tg.IP[len(tg.IP)-2] == prev[len(prev)-2] {
+			adjacent++
+		}
+		prev = tg.IP
+	}
+	if want := (256 + 64) * len(ports); len(seen) != want {
+		t.Errorf("Generator.Targets() generated %d targets, want %d", len(seen), want)
+	}
+	// the targets of the two subnets are interleaved
+	if adjacent > len(seen)*3/4 {
+		t.Errorf("%d of %d targets follow a target of the same subnet", adjacent, len(seen))
+	}
+}
+
+func TestGenerator_Resume(t *testing.T) {
+	cidrs := []string{"10.0.0.0/30", "10.0.1.0/30"}
+	excludes := []string{"10.0.1.1/32"}
+	ports := []uint16{80, 1080}
+	targets := func(g *Generator) []string {
+		var res []string
+		for tg := range g.Targets(context.Background(), ports) {
+			res = append(res, tg.IP.String()+":"+strconv.Itoa(int(tg.Port)))
+		}
+		return res
+	}
+	g, err := NewGenerator(cidrs, excludes, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := targets(g)
+
+	g, err = NewGenerator(cidrs, excludes, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := g.Targets(ctx, ports)
+	var last Target
+	for i := 0; i < 5; i++ {
+		last = <-ch
+	}
+	cancel()
+	// the position is the index of the 5th target in the permutation, skipped blacklisted targets included
+	var pos uint64
+	perm := newPermutation(g.size*uint64(len(ports)), 3)
+	for taken := 0; ; pos++ {
+		if !g.blacked.contains(g.address(perm.at(pos) / uint64(len(ports)))) {
+			if taken++; taken == 5 {
+				break
+			}
+		}
+	}
+	// the position is updated after the target is taken
+	for deadline := time.Now().Add(time.Second); g.Position() != pos; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Generator.Position() = %v, want %v", g.Position(), pos)
+		}
+	}
+
+	g, err = NewGenerator(cidrs, excludes, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Resume(pos)
+	rest := targets(g)
+	if rest[0] != last.IP.String()+":"+strconv.Itoa(int(last.Port)) {
+		t.Errorf("Generator.Targets() resumed from %v, want %v", rest[0], last)
+	}
+	if strings.Join(rest, ",") != strings.Join(all[4:], ",") {
+		t.Errorf("Generator.Targets() after resume = %v, want %v", rest, all[4:])
+	}
+	if len(all) != 14 {
+		t.Errorf("Generator.Targets() generated %d targets, want 14", len(all))
+	}
+}
+
+func TestGenerator_Shard(t *testing.T) {
+	cidrs := []string{"10.0.0.0/24", "10.0.2.0/28", "172.16.5.7/32", "10.0.3.0/25"}
+	blacklist := []string{"10.0.0.64/26", "10.0.3.0/30"}
+	ports := []uint16{80, 1080, 3128}
+	want := (256 - 64 + 16 + 1 + 128 - 4) * len(ports)
+	for _, shards := range []uint64{1, 2, 3, 7, 64} {
+		seen := make(map[string]uint64)
+		for i := uint64(0); i < shards; i++ {
+			g, err := NewGenerator(cidrs, blacklist, 11)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := g.Shard(i, shards); err != nil {
+				t.Fatal(err)
+			}
+			cnt := 0
+			for tg := range g.Targets(context.Background(), ports) {
+				k := tg.IP.String() + ":" + strconv.Itoa(int(tg.Port))
+				if prev, ok := seen[k]; ok {
+					t.Fatalf("target %s is generated by shards %d and %d of %d", k, prev, i, shards)
+				}
+				seen[k] = i
+				cnt++
+			}
+			// the shards are even up to the blacklisted targets
+			if cnt == 0 {
+				t.Errorf("shard %d of %d is empty", i, shards)
+			}
+		}
+		if len(seen) != want {
+			t.Errorf("%d shards generated %d targets, want %d", shards, len(seen), want)
+		}
+	}
+
+	g, err := NewGenerator(cidrs, blacklist, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Shard(3, 3); err == nil {
+		t.Error("Generator.Shard() accepted an invalid shard")
+	}
+}
+
+func TestGenerator_Targets_ipv6(t *testing.T) {
+	g, err := NewGenerator([]string{"2001:db8::1", "2001:db8:1::/126", "10.0.0.1"}, []string{"2001:db8:1::2"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for ip := range g.Ips(context.Background()) {
+		got = append(got, ip.String())
+	}
+	sort.Strings(got)
+	want := []string{"10.0.0.1", "2001:db8:1::", "2001:db8:1::1", "2001:db8:1::3", "2001:db8::1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Generator.Ips() = %v, want %v", got, want)
+	}
+
+	if _, err := NewGenerator([]string{"2001:db8::/64"}, nil, 5); err == nil {
+		t.Error("NewGenerator() accepted a /64 sweep")
+	}
+	if _, err := NewGenerator([]string{"2001:db8::zz"}, nil, 5); err == nil {
+		t.Error("NewGenerator() accepted an invalid address")
+	}
+}
@@ -0,0 +1,56 @@
+package gen
+
+import (
+	"math/bits"
+)
+
+const feistelRounds = 4
+
+// permutation is a pseudo-random bijection of [0, n) keyed by a seed. It is a balanced Feistel network
+// over the smallest even power of two covering n, values outside of [0, n) are cycle-walked.
+// The power of two is less than 4n, so a value takes less than 4 encryptions on average.
+type permutation struct {
+	n    uint64
+	half uint
+	mask uint64
+	keys [feistelRounds]uint64
+}
+
+func newPermutation(n, seed uint64) *permutation {
+	p := &permutation{n: n}
+	if n > 1 {
+		b := uint(bits.Len64(n - 1))
+		p.half = (b + 1) / 2
+	}
+	p.mask = 1<<p.half - 1
+	for i := range p.keys {
+		seed = mix(seed + uint64(i) + 1)
+		p.keys[i] = seed
+	}
+	return p
+}
+
+// at returns the i-th value of the permutation, i must be less than n
+func (p *permutation) at(i uint64) uint64 {
+	for {
+		i = p.encrypt(i)
+		if i < p.n {
+			return i
+		}
+	}
+}
+
+func (p *permutation) encrypt(x uint64) uint64 {
+	l, r := x>>p.half, x&p.mask
+	for _, k := range p.keys {
+		l, r = r, l^(mix(r^k)&p.mask)
+	}
+	return l<<p.half | r
+}
+
+// mix is the splitmix64 finalizer
+func mix(z uint64) uint64 {
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
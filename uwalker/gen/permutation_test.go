@@ -0,0 +1,45 @@
+package gen
+
+import (
+	"testing"
+)
+
+func Test_permutation(t *testing.T) {
+	for _, n := range []uint64{1, 2, 3, 7, 16, 1000, 65536 + 17} {
+		p := newPermutation(n, 42)
+		seen := make([]bool, n)
+		inOrder := 0
+		for i := uint64(0); i < n; i++ {
+			v := p.at(i)
+			if v >= n {
+				t.Fatalf("permutation(%d).at(%d) = %d is out of range", n, i, v)
+			}
+			if seen[v] {
+				t.Fatalf("permutation(%d) visits %d twice", n, v)
+			}
+			seen[v] = true
+			if v == i {
+				inOrder++
+			}
+		}
+		if n >= 1000 && inOrder > int(n/100) {
+			t.Errorf("permutation(%d) keeps %d values in place", n, inOrder)
+		}
+	}
+}
+
+func Test_permutation_seed(t *testing.T) {
+	a, b := newPermutation(1000, 1), newPermutation(1000, 2)
+	same := 0
+	for i := uint64(0); i < 1000; i++ {
+		if a.at(i) == b.at(i) {
+			same++
+		}
+		if a.at(i) != newPermutation(1000, 1).at(i) {
+			t.Fatal("permutation is not deterministic")
+		}
+	}
+	if same > 10 {
+		t.Errorf("permutations with different seeds share %d values", same)
+	}
+}
@@ -1,27 +1,41 @@
 package gen
 
 import (
+	"bytes"
 	"net"
 	"sort"
 )
 
-func toInt(n net.IP) uint32 {
-	var res uint32 = 0
-	for i := 0; i < 4; i++ {
-		res <<= 8
-		res |= uint32(n[i])
-	}
-	return res
+// compare orders addresses of the same family as 128-bit numbers
+func compare(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
 }
 
-// sSet stores subnets and allows checking an IP for intersection with any subnet
+// sSet stores subnets and allows checking an IP for intersection with any subnet.
+// The families are kept apart, IPv4 subnets never contain IPv6 addresses and vice versa.
 type sSet struct {
-	subnets []*net.IPNet
+	subnets4, subnets6 []*net.IPNet
 }
 
 func newSSet(subnets []*net.IPNet) *sSet {
+	var subnets4, subnets6 []*net.IPNet
+	for _, s := range subnets {
+		if s.IP.To4() != nil {
+			subnets4 = append(subnets4, s)
+		} else {
+			subnets6 = append(subnets6, s)
+		}
+	}
+	return &sSet{
+		subnets4: merge(subnets4),
+		subnets6: merge(subnets6),
+	}
+}
+
+// merge sorts the subnets and drops the ones contained in others
+func merge(subnets []*net.IPNet) []*net.IPNet {
 	sort.Slice(subnets, func(i, j int) bool {
-		return toInt(subnets[i].IP) < toInt(subnets[j].IP)
+		return compare(subnets[i].IP, subnets[j].IP) < 0
 	})
 	filtered := make([]*net.IPNet, 0)
 	for _, s := range subnets {
@@ -42,16 +56,16 @@ func newSSet(subnets []*net.IPNet) *sSet {
 		}
 		filtered = append(filtered, s)
 	}
-
-	return &sSet{
-		subnets: filtered,
-	}
+	return filtered
 }
 
 func (s *sSet) contains(ip net.IP) bool {
-	ipInt := toInt(ip.To4())
-	cur := sort.Search(len(s.subnets), func(i int) bool {
-		return toInt(s.subnets[i].IP) > ipInt
+	subnets := s.subnets6
+	if ip.To4() != nil {
+		subnets = s.subnets4
+	}
+	cur := sort.Search(len(subnets), func(i int) bool {
+		return compare(subnets[i].IP, ip) > 0
 	}) - 1
-	return cur >= 0 && s.subnets[cur].Contains(ip)
+	return cur >= 0 && subnets[cur].Contains(ip)
 }
@@ -54,6 +54,26 @@ func Test_newSSet(t *testing.T) {
 			args{exSnets, net.ParseIP("192.175.48.1")},
 			true,
 		},
+		{"ipv6",
+			args{append(exSnets, snet("2001:db8::/32"), snet("fe80::/10")), net.ParseIP("2001:db8:1::5")},
+			true,
+		},
+		{"ipv6 public",
+			args{append(exSnets, snet("2001:db8::/32"), snet("fe80::/10")), net.ParseIP("2a00:1450::1")},
+			false,
+		},
+		{"ipv4 among ipv6",
+			args{append(exSnets, snet("2001:db8::/32"), snet("::/8")), net.ParseIP("10.1.1.1")},
+			true,
+		},
+		{"ipv6 above the mapped ipv4",
+			args{append(exSnets, snet("::/8")), net.ParseIP("0:0:0:1::1")},
+			true,
+		},
+		{"ipv6 among ipv4",
+			args{exSnets, net.ParseIP("a00::1")},
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
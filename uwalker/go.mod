@@ -8,4 +8,5 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4
 )
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	_ "embed"
+	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/pkg/errors"
 	"io"
@@ -14,9 +15,10 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
-	"uwalker/banner"
+	"uwalker/firewall"
 	"uwalker/gen"
 	"uwalker/limiter"
+	"uwalker/report"
 	"uwalker/router"
 	"uwalker/scan"
 	"uwalker/storage"
@@ -35,13 +37,36 @@ func readCIDR(r io.Reader) ([]string, error) {
 }
 
 var opts struct {
-	TestHost  string `long:"test-host" default:"google.com:80"`
-	Subnet    string `short:"s" description:"Subnet to scan, e.g 192.168.0.1/24"`
-	Cidrs     string `short:"f" description:"File with subnets to scan"`
-	Ports     string `short:"p" env:"PROBE_PORTS" description:"Ports to scan, e.g comma separated \"2055,2056,1999\" or ranges \"2055-2059,1999\"" required:"true"`
-	BlackList string `short:"b" description:"Specifies file with excluded subnets from scanning in the same format as the subnets for scanning. If it is not specified, the default one would be used"`
-	Rate      uint32 `short:"r" env:"PROBE_RATE" description:"Max probing rate in packet/s" default:"100"`
-	Sqlite    string `long:"sqlite" description:"Path to the SQLite database" default:"db.sqlite"`
+	TestHost        string            `long:"test-host" description:"Destination requested from proxies to detect their protocol" default:"google.com:80"`
+	Subnet          string            `short:"s" description:"Subnet to scan, e.g 192.168.0.1/24"`
+	Cidrs           string            `short:"f" description:"File with subnets to scan"`
+	Ports           string            `short:"p" env:"PROBE_PORTS" description:"Ports to scan, e.g comma separated \"2055,2056,1999\" or ranges \"2055-2059,1999\""`
+	Protocols       string            `long:"protocols" env:"PROBE_PROTOCOLS" description:"Comma separated protocols to detect in the order of probing, e.g \"socks5,socks4,http\". socks4 detects socks4a as well, http-get detects http proxies with GET instead of CONNECT" default:"socks5"`
+	PortProtocols   map[string]string `long:"port-protocols" description:"Protocols to detect on the port instead of the default ones, e.g \"3128:http,socks5\". May be repeated"`
+	BlackList       string            `short:"b" description:"Specifies file with excluded subnets from scanning in the same format as the subnets for scanning. If it is not specified, the default one would be used"`
+	Rate            uint32            `short:"r" env:"PROBE_RATE" description:"Max probing rate in packet/s" default:"100"`
+	Sqlite          string            `long:"sqlite" description:"Path to the SQLite database" default:"db.sqlite"`
+	Ursus           string            `long:"ursus" env:"URSUS_ADDRESS" description:"Address of the ursus control server to report found proxies to, e.g 10.0.0.1:34231"`
+	UrsusKey        string            `long:"ursus-key" env:"URSUS_KEY" description:"Shared key to authenticate to ursus"`
+	Seed            uint64            `long:"seed" env:"PROBE_SEED" description:"Seed of the pseudo-random order of targets. It is derived from the subnets, ports and excludes if not specified"`
+	Shard           string            `long:"shard" env:"PROBE_SHARD" description:"Scan only a part of the targets, e.g \"0/3\", \"1/3\" and \"2/3\" split the scan between three walkers. The walkers must use the same seed"`
+	Resume          bool              `long:"resume" description:"Continue the scan with the same subnets, ports, excludes and seed from the last checkpoint"`
+	Worker          bool              `long:"worker" description:"Scan shards of jobs dispatched by ursus instead of the subnets from the command line"`
+	WalkerID        string            `long:"walker-id" env:"WALKER_ID" description:"Identity of this walker reported to ursus. The hostname is used if it is not specified"`
+	Backend         string            `long:"backend" env:"PROBE_BACKEND" description:"How to probe targets: pcap sends raw packets and needs root, ring sends them faster through the AF_PACKET rings on Linux, connect uses ordinary connections and needs no privileges" choice:"pcap" choice:"ring" choice:"connect" default:"pcap"`
+	Connections     int               `long:"connections" env:"PROBE_CONNECTIONS" description:"Max connections open at once with the connect backend" default:"512"`
+	MaxInFlight     int               `long:"max-in-flight" env:"PROBE_MAX_IN_FLIGHT" description:"Max connections open or awaiting the answer to the SYN at once, 0 is unlimited. New SYNs are paused while the table is full, the oldest idle connections are reset to make room for the unexpected answers" default:"65536"`
+	Iface           string            `long:"iface" env:"PROBE_IFACE" description:"Interface to scan through instead of the one routed to the route target. The gateway MAC must be set if the route target is routed through another interface"`
+	SourceIP        string            `long:"source-ip" env:"PROBE_SOURCE_IP" description:"Source IPv4 address of the probes instead of the routed one"`
+	GatewayMAC      string            `long:"gateway-mac" env:"PROBE_GATEWAY_MAC" description:"MAC the probes are sent to instead of the MAC of the gateway resolved with ARP"`
+	RouteTarget     string            `long:"route-target" env:"PROBE_ROUTE_TARGET" description:"IPv4 address routed to find the interface, the source address and the gateway of the probes" default:"1.1.1.1"`
+	ListInterfaces  bool              `long:"list-interfaces" description:"List the interfaces and the route the probes would take, then exit"`
+	SynRetries      int               `long:"syn-retries" env:"PROBE_SYN_RETRIES" description:"How many times an unanswered SYN is resent by the pcap and ring backends, the backoff starts at a second and doubles" default:"2"`
+	Retransmissions int               `long:"retransmissions" env:"PROBE_RETRANSMISSIONS" description:"How many times unacknowledged data is resent before the connection is reset" default:"3"`
+	SourcePorts     string            `long:"source-ports" env:"PROBE_SOURCE_PORTS" description:"Source ports of the probes of the pcap and ring backends, e.g \"55324\" or \"55000-55999\". The incoming TCP packets to them are dropped with iptables or nftables while scanning" default:"55324"`
+	PcapOut         string            `long:"pcap-out" env:"PROBE_PCAP_OUT" description:"Write the frames sent and received by the pcap and ring backends to the pcapng file"`
+	Replay          string            `long:"replay" description:"Detect the protocols in the replies recorded with --pcap-out and print them instead of scanning, nothing is sent"`
+	RemoveStale     bool              `long:"remove-stale-rules" description:"Remove the firewall rules left by the walkers that didn't exit cleanly, then exit. The rules of the running walkers are removed too"`
 }
 
 func parsePorts(p string) ([]uint16, error) {
@@ -84,6 +109,71 @@ func parsePorts(p string) ([]uint16, error) {
 	return ports, nil
 }
 
+// parseSourcePorts parses a single port or a range of ports
+func parseSourcePorts(p string) (scan.PortRange, error) {
+	parts := strings.Split(p, "-")
+	if len(parts) > 2 {
+		return scan.PortRange{}, errors.Errorf("invalid source port range %s format", p)
+	}
+	var r [2]uint16
+	for i, part := range parts {
+		port, err := strconv.ParseUint(strings.TrimSpace(part), 10, 16)
+		if err != nil || port == 0 {
+			return scan.PortRange{}, errors.Errorf("invalid source port range %s format", p)
+		}
+		r[i] = uint16(port)
+	}
+	if len(parts) == 1 {
+		r[1] = r[0]
+	}
+	if r[1] < r[0] {
+		return scan.PortRange{}, errors.Errorf("source port range %s is reversed", p)
+	}
+	return scan.PortRange{First: r[0], Last: r[1]}, nil
+}
+
+// routeOptions builds the overrides of the route of the probes from the flags
+func routeOptions() (scan.RouteOptions, error) {
+	var o scan.RouteOptions
+	o.Iface = opts.Iface
+	if o.Target = net.ParseIP(opts.RouteTarget); o.Target == nil || o.Target.To4() == nil {
+		return o, errors.Errorf("invalid route target %s, it must be an IPv4 address", opts.RouteTarget)
+	}
+	if opts.SourceIP != "" {
+		if o.Src = net.ParseIP(opts.SourceIP); o.Src == nil || o.Src.To4() == nil {
+			return o, errors.Errorf("invalid source IP %s, it must be an IPv4 address", opts.SourceIP)
+		}
+	}
+	if opts.GatewayMAC != "" {
+		mac, err := net.ParseMAC(opts.GatewayMAC)
+		if err != nil {
+			return o, errors.Wrap(err, "invalid gateway MAC")
+		}
+		o.GatewayMAC = mac
+	}
+	return o, nil
+}
+
+// parseShard parses the shard in the i/N format, i starts from 0
+func parseShard(s string) (uint64, uint64, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid shard %s format", s)
+	}
+	i, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid shard %s format", s)
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid shard %s format", s)
+	}
+	if n == 0 || i >= n {
+		return 0, 0, errors.Errorf("shard %s is out of range, it must be from 0/N to N-1/N", s)
+	}
+	return i, n, nil
+}
+
 func getExcludes(blacklist string) ([]string, error) {
 	if blacklist == "" {
 		return readCIDR(strings.NewReader(defaultBlacklist))
@@ -98,6 +188,14 @@ func getCIDRs(path string, subnet string) ([]string, error) {
 	return readCIDRFile(path)
 }
 
+// targets describes the scanned subnets for humans
+func targets(path string, subnet string) string {
+	if subnet != "" {
+		return subnet
+	}
+	return path
+}
+
 func readCIDRFile(path string) ([]string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -107,40 +205,73 @@ func readCIDRFile(path string) ([]string, error) {
 	return readCIDR(f)
 }
 
+func walkerID(id string) string {
+	if id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
 func main() {
 	_, err := flags.Parse(&opts)
 	if err != nil {
 		os.Exit(1)
 	}
-	if opts.Cidrs == "" && opts.Subnet == "" {
-		println("Either subnet or file with subnets to scan must be defined. See the -h")
+	if opts.ListInterfaces {
+		if err := listInterfaces(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if opts.RemoveStale {
+		removed, err := firewall.RemoveStale()
+		if err != nil {
+			log.Fatal("failed to remove the stale firewall rules: ", err)
+		}
+		log.Printf("removed %d stale firewall rules", removed)
+		return
+	}
+	if opts.Replay != "" {
+		detectors, err := parseDetectors(opts.TestHost, opts.Protocols, opts.PortProtocols)
+		if err != nil {
+			log.Fatal("failed to parse protocols to detect: ", err)
+		}
+		if err := replay(opts.Replay, detectors, os.Stdout); err != nil {
+			log.Fatal("failed to replay the capture: ", err)
+		}
+		return
+	}
+	if opts.Worker && opts.Ursus == "" {
+		println("Worker mode requires the ursus address. See the -h")
 		os.Exit(1)
 	}
-	ports, err := parsePorts(opts.Ports)
-	if err != nil {
-		log.Fatal("failed to parse ports for scanning: ", err)
+	if !opts.Worker && opts.Cidrs == "" && opts.Subnet == "" {
+		println("Either subnet or file with subnets to scan must be defined. See the -h")
+		os.Exit(1)
 	}
-	excludes, err := getExcludes(opts.BlackList)
-	if err != nil {
-		log.Fatal("failed to read the file with excludes: ", err)
+	if opts.Worker && opts.Shard != "" {
+		println("Shards are dispatched by ursus in the worker mode. See the -h")
+		os.Exit(1)
 	}
-	ips, err := getCIDRs(opts.Cidrs, opts.Subnet)
-	if err != nil {
-		log.Fatal("failed to read the file with subnets for scanning: ", err)
+	if !opts.Worker && opts.Ports == "" {
+		println("Ports to scan must be defined. See the -h")
+		os.Exit(1)
 	}
-
-	gen, err := gen.NewGenerator(ips, excludes)
-	if err != nil {
-		log.Fatal("failed to init the tool with provided subnets: ", err)
+	if opts.MaxInFlight < 0 {
+		println("Max connections in flight can't be negative. See the -h")
+		os.Exit(1)
 	}
-	l := limiter.NewLogLimiter(opts.Rate)
-	r, err := router.New()
+	detectors, err := parseDetectors(opts.TestHost, opts.Protocols, opts.PortProtocols)
 	if err != nil {
-		log.Fatal("failed to init routing subsystem: ", err)
+		log.Fatal("failed to parse protocols to detect: ", err)
 	}
-	s, err := scan.NewScanner(net.IPv4(1, 1, 1, 1), r)
+	excludes, err := getExcludes(opts.BlackList)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("failed to read the file with excludes: ", err)
 	}
 	engine, err := storage.NewSqlite(opts.Sqlite)
 	if err != nil {
@@ -150,31 +281,255 @@ func main() {
 	if err != nil {
 		log.Fatal("failed to init the store: ", err)
 	}
-	c := NewConductor(ports, s, l, func() ConnectionState {
-		return &banner.Socks5{}
-	})
+	// the inputs are validated first, the backend installs the firewall rules removed only by its release
+	var sc *cliScan
+	if !opts.Worker {
+		if sc, err = newCLIScan(excludes, store); err != nil {
+			log.Fatal(err)
+		}
+		if sc == nil {
+			return
+		}
+	}
+	s, release, err := newBackend(opts.Backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var reporter *report.Reporter
+	reportCtx, stopReporting := context.WithCancel(context.Background())
+	if opts.Ursus != "" {
+		reporter = report.NewReporter(opts.Ursus, walkerID(opts.WalkerID), opts.UrsusKey)
+		go reporter.Run(reportCtx)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigs
 		cancel()
 	}()
-	established := c.Collect(s.Packets(ctx))
+	if opts.Worker {
+		work(ctx, s, detectors, excludes, store, reporter)
+	} else {
+		scanTargets(ctx, s, sc, detectors, store, reporter)
+	}
+	if err := release(); err != nil {
+		log.Printf("failed to release the backend: %v", err)
+	}
+	stopReporting()
+	if reporter != nil {
+		<-reporter.Done()
+	}
+}
+
+// newBackend creates the backend by name, release frees what the backend holds outside the process
+func newBackend(name string) (b Backend, release func() error, err error) {
+	if name == "connect" {
+		if opts.PcapOut != "" {
+			return nil, nil, errors.New("the frames are recorded by the pcap and ring backends only")
+		}
+		if opts.Connections <= 0 {
+			return nil, nil, errors.New("the number of connections must be positive")
+		}
+		return scan.NewConnector(opts.Connections, timeout), func() error { return nil }, nil
+	}
+	ports, err := parseSourcePorts(opts.SourcePorts)
+	if err != nil {
+		return nil, nil, err
+	}
+	route, err := routeOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := router.New()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to init routing subsystem")
+	}
+	// the kernel resets every handshake of the probes unless the replies are dropped
+	release, err = firewall.DropInput(ports.First, ports.Last)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to drop the incoming packets to the source ports, the handshakes would be reset by the kernel")
+	}
+	newScanner := scan.NewScanner
+	if name == "ring" {
+		newScanner = scan.NewRingScanner
+	}
+	s, err := newScanner(r, route, ports)
+	if err != nil {
+		_ = release()
+		return nil, nil, err
+	}
+	log.Printf("probing through %s", s)
+	drop := release
+	stop := func() error { return nil }
+	if opts.PcapOut != "" {
+		if stop, err = record(s, opts.PcapOut); err != nil {
+			_ = s.Close()
+			_ = drop()
+			return nil, nil, err
+		}
+	}
+	release = func() error {
+		err := stop()
+		if cerr := s.Close(); err == nil {
+			err = errors.Wrap(cerr, "failed to close the link")
+		}
+		if rerr := drop(); err == nil {
+			err = errors.Wrap(rerr, "failed to remove the firewall rules")
+		}
+		return err
+	}
+	return s, release, nil
+}
+
+// listInterfaces writes the interfaces with their addresses and the route the probes would take
+func listInterfaces(w io.Writer) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return errors.Wrap(err, "failed to list the interfaces")
+	}
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			return errors.Wrapf(err, "failed to list the addresses of %s", i.Name)
+		}
+		var as []string
+		for _, a := range addrs {
+			as = append(as, a.String())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", i.Name, i.HardwareAddr, i.Flags, strings.Join(as, ","))
+	}
+	if opts.Backend == "connect" {
+		fmt.Fprintln(w, "\nthe connect backend probes through the routes of the kernel")
+		return nil
+	}
+	route, err := routeOptions()
+	if err != nil {
+		return err
+	}
+	r, err := router.New()
+	if err != nil {
+		return errors.Wrap(err, "failed to init routing subsystem")
+	}
+	newScanner := scan.NewScanner
+	if opts.Backend == "ring" {
+		newScanner = scan.NewRingScanner
+	}
+	// the source ports don't matter, nothing is probed
+	s, err := newScanner(r, route, scan.PortRange{First: 1, Last: 1})
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve the route of the probes")
+	}
+	defer s.Close()
+	fmt.Fprintf(w, "\nprobes to %s go through %s\n", route.Target, s)
+	return nil
+}
+
+// cliScan is the scan of the subnets and ports from the command line
+type cliScan struct {
+	id, progressID string
+	ports          []uint16
+	g              *gen.Generator
+}
+
+// newCLIScan validates the scan from the command line before anything is installed on the host.
+// It returns nil if the resumed scan is already finished.
+func newCLIScan(excludes []string, store *storage.Store) (*cliScan, error) {
+	ports, err := parsePorts(opts.Ports)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse ports for scanning")
+	}
+	ips, err := getCIDRs(opts.Cidrs, opts.Subnet)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the file with subnets for scanning")
+	}
+	id := scanID(ips, opts.Ports, excludes, opts.Seed)
+	g, err := gen.NewGenerator(ips, excludes, seed(id, opts.Seed))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to init the tool with provided subnets")
+	}
+	// the shards of the scan share the seed derived from the scan id, but not the progress
+	progressID := id
+	if opts.Shard != "" {
+		i, n, err := parseShard(opts.Shard)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.Shard(i, n); err != nil {
+			return nil, err
+		}
+		progressID = fmt.Sprintf("%s-%dof%d", id, i, n)
+	}
+	if opts.Resume {
+		ok, err := resume(store, g, progressID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to resume the scan")
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	return &cliScan{id: id, progressID: progressID, ports: ports, g: g}, nil
+}
+
+// scanTargets scans the subnets and ports from the command line
+func scanTargets(ctx context.Context, b Backend, sc *cliScan, detectors Detectors, store *storage.Store, reporter *report.Reporter) {
+	if reporter != nil {
+		reporter.SetScan(report.Scan{
+			ID:      sc.id,
+			Targets: targets(opts.Cidrs, opts.Subnet),
+			Ports:   opts.Ports,
+			Rate:    opts.Rate,
+		})
+	}
+	stop := checkpoint(store, sc.g, storage.Checkpoint{
+		ScanID:  sc.progressID,
+		Targets: targets(opts.Cidrs, opts.Subnet),
+		Ports:   opts.Ports,
+	})
+	run(ctx, b, sc.g, sc.ports, detectors, opts.Rate, store, reporter)
+	stop(ctx.Err() == nil)
+}
+
+// recovery configures the loss recovery from the flags
+func recovery() Recovery {
+	r := defaultRecovery
+	r.SynRetries, r.Retransmissions = opts.SynRetries, opts.Retransmissions
+	if opts.Backend == "connect" {
+		r.SynRetries = 0 // the kernel resends the SYNs of the connections
+	}
+	return r
+}
+
+// run scans the targets of the generator and persists found proxies.
+// It returns after all targets are probed or ctx is done and the packets of b are closed,
+// the backends close them after their receivers stop, so the next run doesn't read beside them.
+func run(ctx context.Context, b Backend, g *gen.Generator, ports []uint16, detectors Detectors, rate uint32, store *storage.Store, reporter *report.Reporter) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := NewConductor(b, limiter.NewLogLimiter(rate), detectors, recovery(), opts.MaxInFlight)
+	established := c.Collect(b.Packets(ctx))
 	go func() {
-		_ = c.Transmit(gen.Ips(ctx))
+		_ = c.Transmit(g.Targets(ctx, ports))
 		cancel()
 	}()
-	persist(store, established)
+	go logTable(ctx, c)
+	persist(store, reporter, established)
 }
 
-func persist(store *storage.Store, established <-chan Protocol) {
+func persist(store *storage.Store, reporter *report.Reporter, established <-chan Protocol) {
 	for e := range established {
-		log.Printf("protocol %s detected at the %s:%d", e.Proto, e.Ip.String(), e.Port)
-		if err := store.PersistBanner(e.Ip, e.Port, e.Proto); err != nil {
+		log.Printf("protocol %s detected at the %s:%d, auth %s, rtt %s", e.Proto, e.Ip.String(), e.Port, strings.Join(e.Auth, ","), e.RTT)
+		if err := store.PersistBanner(e.Ip, e.Port, e.Result); err != nil {
 			log.Println("failed to persist the banner")
 		}
+		if reporter == nil {
+			continue
+		}
+		if err := reporter.Report(e.Ip, e.Port, e.Result); err != nil {
+			log.Printf("failed to report the banner to ursus: %v", err)
+		}
 	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"uwalker/scan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseShard(t *testing.T) {
+	i, n, err := parseShard("2/3")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), i)
+	assert.Equal(t, uint64(3), n)
+	for _, bad := range []string{"3/3", "0/0", "1", "a/2", "1/2/3", "-1/2"} {
+		_, _, err := parseShard(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func Test_parseSourcePorts(t *testing.T) {
+	r, err := parseSourcePorts("55000-55999")
+	require.NoError(t, err)
+	assert.Equal(t, scan.PortRange{First: 55000, Last: 55999}, r)
+	r, err = parseSourcePorts("55324")
+	require.NoError(t, err)
+	assert.Equal(t, scan.PortRange{First: 55324, Last: 55324}, r)
+	for _, bad := range []string{"", "0", "0-10", "2-1", "1-2-3", "a", "70000"} {
+		_, err := parseSourcePorts(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func Test_routeOptions(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	opts.RouteTarget, opts.Iface, opts.SourceIP, opts.GatewayMAC = "8.8.8.8", "eth1", "10.0.0.2", "02:00:00:00:00:01"
+	o, err := routeOptions()
+	require.NoError(t, err)
+	assert.Equal(t, "eth1", o.Iface)
+	assert.Equal(t, "8.8.8.8", o.Target.String())
+	assert.Equal(t, "10.0.0.2", o.Src.String())
+	assert.Equal(t, "02:00:00:00:00:01", o.GatewayMAC.String())
+
+	for _, bad := range []struct{ target, src, mac string }{
+		{"2001:db8::1", "", ""},
+		{"1.1.1.1", "host", ""},
+		{"1.1.1.1", "2001:db8::1", ""},
+		{"1.1.1.1", "", "02:00"},
+	} {
+		opts.RouteTarget, opts.SourceIP, opts.GatewayMAC = bad.target, bad.src, bad.mac
+		_, err := routeOptions()
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Recovery configures the loss recovery of the conductor
+type Recovery struct {
+	// SynRetries is how many times an unanswered SYN is resent, the backoff doubles after every retry
+	SynRetries int
+	SynBackoff time.Duration
+	// Retransmissions is how many times unacknowledged data is resent before the connection is reset,
+	// the RTO of a connection doubles after every retransmission
+	Retransmissions int
+	RTO             time.Duration
+}
+
+var defaultRecovery = Recovery{
+	SynRetries:      2,
+	SynBackoff:      time.Second,
+	Retransmissions: 3,
+	RTO:             time.Second,
+}
+
+const (
+	// minRTO bounds the RTO estimated from the round trip of the first request
+	minRTO = 200 * time.Millisecond
+	// dupAcks trigger the retransmission of the unacknowledged data without waiting for the RTO
+	dupAcks = 3
+)
+
+// Stats counts the detected protocols and the packets resent to detect them, it also tells the occupancy of the connection table
+type Stats struct {
+	Hits uint64
+	// SynRetryHits are the hits of the connections answering a resent SYN,
+	// RetransmitHits of the connections with resent data
+	SynRetryHits   uint64
+	RetransmitHits uint64
+
+	SynRetries      uint64
+	Retransmissions uint64
+
+	// Open and HalfOpen are the connections in the table and the SYNs awaiting an answer at the moment,
+	// Evicted counts the idle connections reset to make room for the new ones
+	Open     uint64
+	HalfOpen uint64
+	Evicted  uint64
+}
+
+// probe is a SYN awaiting an answer
+type probe struct {
+	key     connectionKey
+	addr    net.IP
+	attempt int
+	due     time.Time
+}
+
+// probes keeps the unanswered SYNs to resend them and to count the half-open connections, nil probes resend nothing.
+// The probes are queued by attempt, as the backoff of an attempt is the same for all probes, each queue is ordered
+// by the time the probes are due. The last queue keeps the probes after the last retry to count the hits of the retries
+// and the SYNs awaiting an answer, with no retries the SYN is awaited for a backoff.
+type probes struct {
+	retries int
+	backoff time.Duration
+
+	mu      sync.Mutex
+	pending map[connectionKey]*probe
+	queues  [][]*probe
+}
+
+func newProbes(r Recovery) *probes {
+	backoff := r.SynBackoff
+	if backoff <= 0 {
+		backoff = defaultRecovery.SynBackoff // the SYNs are awaited even without the recovery
+	}
+	retries := r.SynRetries
+	if retries < 0 {
+		retries = 0
+	}
+	return &probes{
+		retries: retries,
+		backoff: backoff,
+		pending: make(map[connectionKey]*probe),
+		queues:  make([][]*probe, retries+1),
+	}
+}
+
+// sent registers the first SYN to the target, the previous probes of the target are forgotten
+func (p *probes) sent(addr net.IP, port uint16, now time.Time) {
+	if p == nil {
+		return
+	}
+	pr := &probe{key: connectionKey{addr.String(), port}, addr: addr, due: now.Add(p.backoff)}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[pr.key] = pr
+	p.queues[0] = append(p.queues[0], pr)
+}
+
+// answered forgets the probe of the target and returns how many times its SYN was resent
+func (p *probes) answered(k connectionKey) int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.pending[k]
+	if !ok {
+		return 0
+	}
+	delete(p.pending, k)
+	return pr.attempt
+}
+
+// len returns the number of the SYNs awaiting an answer
+func (p *probes) len() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+// next returns a probe due to be resent or nil
+func (p *probes) next(now time.Time) *probe {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, q := range p.queues {
+		for len(q) > 0 && !q[0].due.After(now) {
+			pr := q[0]
+			q = q[1:]
+			if p.pending[pr.key] != pr {
+				continue // answered or probed again
+			}
+			if i == p.retries {
+				delete(p.pending, pr.key)
+				continue
+			}
+			pr.attempt++
+			pr.due = now.Add(p.backoff << uint(pr.attempt))
+			p.queues[i] = q
+			p.queues[i+1] = append(p.queues[i+1], pr)
+			return pr
+		}
+		p.queues[i] = q
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"uwalker/banner"
+	"uwalker/gen"
+	"uwalker/scan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_probes(t *testing.T) {
+	p := newProbes(Recovery{SynRetries: 2, SynBackoff: time.Second})
+	start := time.Unix(0, 0)
+	ip := net.IPv4(10, 0, 0, 1)
+	k := connectionKey{ip.String(), 1080}
+	p.sent(ip, 1080, start)
+	p.sent(net.IPv4(10, 0, 0, 2), 1080, start)
+	assert.Nil(t, p.next(start))
+
+	pr := p.next(start.Add(time.Second))
+	require.NotNil(t, pr)
+	assert.Equal(t, k, pr.key)
+	assert.Equal(t, 1, pr.attempt)
+	require.NotNil(t, p.next(start.Add(time.Second)))
+	assert.Equal(t, 1, p.answered(connectionKey{"10.0.0.2", 1080}))
+	assert.Nil(t, p.next(start.Add(2*time.Second)))
+
+	// the second retry is 2s after the first
+	pr = p.next(start.Add(3 * time.Second))
+	require.NotNil(t, pr)
+	assert.Equal(t, k, pr.key)
+	assert.Equal(t, 2, pr.attempt)
+	assert.Nil(t, p.next(start.Add(3*time.Second)))
+
+	// the probe is forgotten after the backoff of the last retry
+	assert.Nil(t, p.next(start.Add(7*time.Second)))
+	assert.Equal(t, 0, p.answered(k))
+	assert.Empty(t, p.pending)
+
+	var none *probes
+	none.sent(ip, 1080, start)
+	assert.Nil(t, none.next(start.Add(time.Hour)))
+	assert.Equal(t, 0, none.answered(k))
+}
+
+// lossyLink simulates targets answering the greeting with the reply over a link dropping packets.
+// The n-th packet of a kind is dropped if its drops have n, the packets are counted from 1.
+// The kinds are our syn and data and the syn-ack and reply of the targets.
+type lossyLink struct {
+	greeting, reply string
+	drops           map[string][]int
+
+	mu      sync.Mutex
+	counts  map[string]int
+	peers   map[connectionKey]*peer
+	packets chan []*scan.Packet
+}
+
+// peer is a target, it resends the reply when the greeting is retransmitted as if its own RTO expired
+type peer struct {
+	recv uint32
+	got  []byte
+}
+
+func newLossyLink(greeting, reply string, drops map[string][]int) *lossyLink {
+	return &lossyLink{
+		greeting: greeting,
+		reply:    reply,
+		drops:    drops,
+		counts:   make(map[string]int),
+		peers:    make(map[connectionKey]*peer),
+		packets:  make(chan []*scan.Packet, 100),
+	}
+}
+
+// lost counts the packet of the kind and tells whether it's dropped, l.mu must be held
+func (l *lossyLink) lost(kind string) bool {
+	l.counts[kind]++
+	for _, n := range l.drops[kind] {
+		if n == l.counts[kind] {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *lossyLink) count(kind string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[kind]
+}
+
+func (l *lossyLink) Probe(dst net.IP, port uint16) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost("syn") {
+		return nil
+	}
+	l.peers[connectionKey{dst.String(), port}] = &peer{recv: 1}
+	if !l.lost("syn-ack") {
+		l.packets <- []*scan.Packet{{Addr: dst, Port: port, Start: true, Seq: 100, Ack: 1}}
+	}
+	return nil
+}
+
+func (l *lossyLink) ProbeData(dst net.IP, port uint16, seq, ack uint32, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.peers[connectionKey{dst.String(), port}]
+	if l.lost("data") || p == nil || seq > p.recv {
+		return nil
+	}
+	if end := seq + uint32(len(data)); end > p.recv {
+		p.got = append(p.got, data[p.recv-seq:]...)
+		p.recv = end
+	}
+	if string(p.got) == l.greeting && !l.lost("reply") {
+		l.packets <- []*scan.Packet{{Addr: dst, Port: port, Seq: 101, Ack: p.recv, Data: []byte(l.reply)}}
+	}
+	return nil
+}
+
+func (l *lossyLink) Terminate(dst net.IP, port uint16, seq uint32) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts["rst"]++
+	delete(l.peers, connectionKey{dst.String(), port})
+	return nil
+}
+
+func TestConductor_lossyLink(t *testing.T) {
+	recovery := Recovery{SynRetries: 2, SynBackoff: 50 * time.Millisecond, Retransmissions: 3, RTO: 50 * time.Millisecond}
+	tests := []struct {
+		name     string
+		drops    map[string][]int
+		detected bool
+		want     Stats
+	}{
+		{"no loss", nil, true, Stats{Hits: 1}},
+		{"syn", map[string][]int{"syn": {1}}, true, Stats{Hits: 1, SynRetryHits: 1, SynRetries: 1}},
+		{"syn-ack", map[string][]int{"syn-ack": {1, 2}}, true, Stats{Hits: 1, SynRetryHits: 1, SynRetries: 2}},
+		{"data", map[string][]int{"data": {1}}, true, Stats{Hits: 1, RetransmitHits: 1, Retransmissions: 1}},
+		{"reply", map[string][]int{"reply": {1, 2}}, true, Stats{Hits: 1, RetransmitHits: 1, Retransmissions: 2}},
+		{"syn and data", map[string][]int{"syn": {1}, "data": {1}}, true,
+			Stats{Hits: 1, SynRetryHits: 1, RetransmitHits: 1, SynRetries: 1, Retransmissions: 1}},
+		{"every syn", map[string][]int{"syn": {1, 2, 3}}, false, Stats{SynRetries: 2}},
+		{"every data", map[string][]int{"data": {1, 2, 3, 4}}, false, Stats{Retransmissions: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLossyLink("hi", "ok", tt.drops)
+			c := NewConductor(l, noLimit{}, Detectors{Default: []Detector{detector("a", "hi", "ok")}}, recovery, 0)
+			established := c.Collect(l.packets)
+			targets := make(chan gen.Target, 1)
+			targets <- gen.Target{IP: net.IPv4(10, 0, 0, 1), Port: 1080}
+			close(targets)
+			go func() { _ = c.Transmit(targets) }()
+
+			if tt.detected {
+				select {
+				case p := <-established:
+					assert.Equal(t, "a", p.Proto)
+				case <-time.After(2 * time.Second):
+					require.FailNow(t, "protocol is not detected", "%+v", c.Stats())
+				}
+			} else {
+				// the connection is given up and reset, or there are no SYNs left to resend
+				require.Eventually(t, func() bool {
+					return l.count("rst") == 1 || l.count("syn") == recovery.SynRetries+1
+				}, 2*time.Second, time.Millisecond)
+				// nothing is resent after giving up
+				time.Sleep(4 * recovery.RTO)
+			}
+			require.Eventually(t, func() bool { return c.Stats() == tt.want }, time.Second, time.Millisecond,
+				"stats %+v", c.Stats())
+			close(l.packets)
+		})
+	}
+}
+
+// stepState answers each of the expected replies with "next" and detects the protocol after the last
+type stepState struct {
+	replies []string
+}
+
+func (s *stepState) Init() []byte { return []byte("hi") }
+
+func (s *stepState) Read(data []byte) ([]byte, int, int, *banner.Result) {
+	if len(s.replies) == 0 || string(data) != s.replies[0] {
+		return nil, 0, 0, nil
+	}
+	if s.replies = s.replies[1:]; len(s.replies) == 0 {
+		return nil, len(data), 0, &banner.Result{Proto: "step"}
+	}
+	return []byte("next"), len(data), 0, nil
+}
+
+func TestConductor_duplicates(t *testing.T) {
+	s := &fakeSender{sent: make(chan sent, 10)}
+	c := NewConductor(s, noLimit{}, Detectors{
+		Default: []Detector{func() ConnectionState { return &stepState{replies: []string{"step", "ok"}} }},
+	}, Recovery{Retransmissions: 3, RTO: time.Minute}, 0)
+	packets := make(chan []*scan.Packet)
+	established := c.Collect(packets)
+	targets := make(chan gen.Target)
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+	ip := net.IPv4(10, 0, 0, 1)
+
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Start: true, Seq: 100, Ack: 1}}
+	assert.Equal(t, sent{op: "data", seq: 1, data: []byte("hi")}, next(t, s))
+	// the greeting is lost, the party acks the SYN only
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Seq: 101, Ack: 1}, {Addr: ip, Port: 1080, Seq: 101, Ack: 1}}
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Seq: 101, Ack: 1}}
+	assert.Equal(t, sent{op: "data", seq: 1, data: []byte("hi")}, next(t, s))
+
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Seq: 101, Ack: 3, Data: []byte("step")}}
+	assert.Equal(t, sent{op: "data", seq: 3, data: []byte("next")}, next(t, s))
+	// our ack is lost, the retransmitted segment is acked again instead of killing the connection
+	packets <- []*scan.Packet{{Addr: ip, Port: 1080, Seq: 101, Ack: 3, Data: []byte("step")}}
+	assert.Equal(t, sent{op: "data", seq: 3, data: []byte("next")}, next(t, s))
+
+	go func() {
+		packets <- []*scan.Packet{{Addr: ip, Port: 1080, Seq: 105, Ack: 7, Data: []byte("ok")}}
+	}()
+	select {
+	case p := <-established:
+		assert.Equal(t, "step", p.Proto)
+	case <-time.After(time.Second):
+		require.FailNow(t, "protocol is not detected")
+	}
+	assert.Equal(t, sent{op: "rst", seq: 7}, next(t, s))
+	assert.Equal(t, Stats{Hits: 1, RetransmitHits: 1, Retransmissions: 1}, c.Stats())
+	close(packets)
+}
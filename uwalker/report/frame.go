@@ -0,0 +1,186 @@
+package report
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sort"
+)
+
+// Frames of the ursus control protocol v2:
+//
+//	magic (1) | version (1) | type (1) | payload length (4, big endian) | payload
+const (
+	frameMagic   = 0x55
+	frameVersion = 0x02
+	headerLen    = 7
+	maxPayload   = 1 << 20
+)
+
+const (
+	frameHeartbeat    = 0x0
+	frameHeartbeatAck = 0x1
+	frameBatch        = 0x2
+	frameBatchAck     = 0x3
+	frameHello        = 0x4
+	frameChallenge    = 0x5
+	frameAuth         = 0x6
+	frameAuthOk       = 0x7
+	frameShardRequest = 0x8
+	frameShard        = 0x9
+	frameShardDone    = 0xa
+	frameShardDoneAck = 0xb
+)
+
+// batch and heartbeat metadata keys
+const (
+	metaScanID   = 0x1
+	metaWalkerID = 0x2
+	metaTargets  = 0x3
+	metaPorts    = 0x4
+	metaRate     = 0x5
+	metaShardID  = 0x6
+)
+
+// proxy attribute keys
+const (
+	attrServer   = 0x1
+	attrVia      = 0x2
+	attrAuth     = 0x3
+	attrVersion  = 0x4
+	attrResponse = 0x5
+	attrRTT      = 0x6
+)
+
+// metaAttributes are the keys of the detected proxy metadata known to ursus by name
+var metaAttributes = map[string]byte{
+	"via": attrVia,
+}
+
+var protocols = map[string]byte{
+	"socks5":  0x1,
+	"socks4":  0x2,
+	"socks4a": 0x3,
+	"http":    0x4,
+}
+
+type proxy struct {
+	ip    net.IP
+	port  uint16
+	proto byte
+	attrs map[byte]string
+}
+
+type frame struct {
+	kind    byte
+	payload []byte
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	buf := make([]byte, headerLen+len(payload))
+	buf[0] = frameMagic
+	buf[1] = frameVersion
+	buf[2] = kind
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(payload)))
+	copy(buf[headerLen:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != frameMagic || header[1] != frameVersion {
+		return nil, errors.Errorf("unexpected frame header %x", header[:2])
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if size > maxPayload {
+		return nil, errors.Errorf("frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return &frame{header[2], payload}, nil
+}
+
+// encodeBatch builds the payload of a batch frame
+//
+//	id (4) | metadata count (1) | metadata | proxies count (2) | proxies
+//
+// where a proxy is proto (1) | address length (1) | address | port (2) | attributes count (1) | attributes
+func encodeBatch(id uint32, meta map[byte]string, proxies []proxy) []byte {
+	buf := make([]byte, 4, 64)
+	binary.BigEndian.PutUint32(buf, id)
+	buf = appendAttrs(buf, meta)
+	buf = appendUint16(buf, uint16(len(proxies)))
+	for _, p := range proxies {
+		addr := p.ip
+		if ip4 := addr.To4(); ip4 != nil {
+			addr = ip4
+		}
+		buf = append(buf, p.proto, byte(len(addr)))
+		buf = append(buf, addr...)
+		buf = appendUint16(buf, p.port)
+		buf = appendAttrs(buf, p.attrs)
+	}
+	return buf
+}
+
+// appendAttrs encodes non-empty attributes as key (1) | length (2) | value, ordered by key
+func appendAttrs(buf []byte, attrs map[byte]string) []byte {
+	keys := make([]int, 0, len(attrs))
+	for k, v := range attrs {
+		if v != "" {
+			keys = append(keys, int(k))
+		}
+	}
+	sort.Ints(keys)
+	buf = append(buf, byte(len(keys)))
+	for _, k := range keys {
+		v := attrs[byte(k)]
+		buf = append(buf, byte(k))
+		buf = appendUint16(buf, uint16(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+// decodeAttrs decodes attributes encoded by appendAttrs
+func decodeAttrs(payload []byte) (map[byte]string, error) {
+	res := make(map[byte]string)
+	if len(payload) == 0 {
+		return res, nil
+	}
+	cnt := int(payload[0])
+	payload = payload[1:]
+	for i := 0; i < cnt; i++ {
+		if len(payload) < 3 {
+			return nil, errors.New("unexpected end of attributes")
+		}
+		l := int(binary.BigEndian.Uint16(payload[1:]))
+		if len(payload) < 3+l {
+			return nil, errors.New("unexpected end of attributes")
+		}
+		res[payload[0]] = string(payload[3 : 3+l])
+		payload = payload[3+l:]
+	}
+	if len(payload) != 0 {
+		return nil, errors.Errorf("%d trailing bytes after attributes", len(payload))
+	}
+	return res, nil
+}
+
+func decodeBatchAck(payload []byte) (id uint32, saved uint16, err error) {
+	if len(payload) != 6 {
+		return 0, 0, errors.Errorf("invalid batch ack length %d", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), binary.BigEndian.Uint16(payload[4:]), nil
+}
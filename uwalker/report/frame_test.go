@@ -0,0 +1,101 @@
+package report
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// golden frames shared with the ursus control server tests
+var (
+	goldenHeartbeat = []byte{
+		0x55, 0x02, 0x00, // magic, version, heartbeat
+		0x00, 0x00, 0x00, 0x00, // empty payload
+	}
+	goldenHello = []byte{
+		0x55, 0x02, 0x04, // magic, version, hello
+		0x00, 0x00, 0x00, 0x07, // payload length
+		0x01,                            // metadata count
+		0x02, 0x00, 0x03, 'w', '-', '1', // walker id
+	}
+	goldenBatch = []byte{
+		0x55, 0x02, 0x02, // magic, version, batch
+		0x00, 0x00, 0x00, 0x30, // payload length 48
+		0x00, 0x00, 0x00, 0x07, // batch id
+		0x02,                       // metadata count
+		0x01, 0x00, 0x02, 's', '1', // scan id
+		0x02, 0x00, 0x03, 'w', '-', '1', // walker id
+		0x00, 0x02, // proxies count
+		0x01, 0x04, 184, 181, 217, 210, 0x10, 0x31, 0x00, // socks5 184.181.217.210:4145
+		0x04, 0x10, // http, ipv6
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // 2001:db8::1
+		0x0c, 0x38, // port 3128
+		0x00, // no attributes
+	}
+	goldenBatchAck = []byte{
+		0x55, 0x02, 0x03,
+		0x00, 0x00, 0x00, 0x06,
+		0x00, 0x00, 0x00, 0x07, // batch id
+		0x00, 0x02, // saved
+	}
+)
+
+func Test_writeFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeFrame(buf, frameHeartbeat, nil))
+	assert.Equal(t, goldenHeartbeat, buf.Bytes())
+
+	buf.Reset()
+	require.NoError(t, writeFrame(buf, frameHello, appendAttrs(nil, map[byte]string{metaWalkerID: "w-1"})))
+	assert.Equal(t, goldenHello, buf.Bytes())
+
+	buf.Reset()
+	payload := encodeBatch(7, map[byte]string{
+		metaWalkerID: "w-1",
+		metaScanID:   "s1",
+	}, []proxy{
+		{net.ParseIP("184.181.217.210"), 4145, protocols["socks5"], nil},
+		{net.ParseIP("2001:db8::1"), 3128, protocols["http"], nil},
+	})
+	require.NoError(t, writeFrame(buf, frameBatch, payload))
+	assert.Equal(t, goldenBatch, buf.Bytes())
+}
+
+func Test_encodeBatch_attributes(t *testing.T) {
+	payload := encodeBatch(1, nil, []proxy{
+		{net.ParseIP("10.0.0.1"), 3128, protocols["http"], map[byte]string{attrVia: "1.1 a", attrServer: "b"}},
+	})
+	assert.Equal(t, []byte{
+		0, 0, 0, 1, // batch id
+		0,    // metadata count
+		0, 1, // proxies count
+		0x04, 0x04, 10, 0, 0, 1, 0x0c, 0x38, // http 10.0.0.1:3128
+		0x02,                  // attributes count
+		0x01, 0x00, 0x01, 'b', // server
+		0x02, 0x00, 0x05, '1', '.', '1', ' ', 'a', // via
+	}, payload)
+}
+
+func Test_encodeBatch_emptyMeta(t *testing.T) {
+	payload := encodeBatch(1, map[byte]string{metaScanID: ""}, nil)
+	assert.Equal(t, []byte{0, 0, 0, 1, 0, 0, 0}, payload)
+}
+
+func Test_readFrame(t *testing.T) {
+	f, err := readFrame(bytes.NewReader(goldenBatchAck))
+	require.NoError(t, err)
+	assert.Equal(t, byte(frameBatchAck), f.kind)
+	id, saved, err := decodeBatchAck(f.payload)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), id)
+	assert.Equal(t, uint16(2), saved)
+
+	_, err = readFrame(bytes.NewReader([]byte{0x1}))
+	assert.Error(t, err)
+	_, err = readFrame(bytes.NewReader([]byte{0x55, 0x01, 0x01, 0, 0, 0, 0}))
+	assert.Error(t, err)
+}
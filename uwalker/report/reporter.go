@@ -0,0 +1,291 @@
+package report
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"uwalker/banner"
+)
+
+const (
+	// ursus drops the connection if nothing is received for 2 seconds
+	heartbeatInterval = time.Second
+	ioTimeout         = 2 * time.Second
+	maxBackoff        = 30 * time.Second
+	// maxPending limits the number of proxies buffered while ursus is unreachable
+	maxPending = 1 << 16
+	// maxBatch limits the number of proxies sent with a single frame
+	maxBatch = 256
+)
+
+// Reporter keeps a persistent connection to the ursus control server and streams found proxies to it.
+// Proxies are buffered while ursus is unreachable and are sent after reconnecting.
+type Reporter struct {
+	addr     string
+	walkerID string
+	key      []byte
+	scan     Scan
+
+	mu      sync.Mutex
+	pending []proxy
+	notify  chan struct{}
+	batchID uint32
+
+	requests chan *request
+
+	done chan struct{}
+}
+
+// NewReporter creates a reporter identifying itself as walkerID. The key is used to answer
+// the authentication challenge of ursus and may be empty if ursus doesn't require it.
+func NewReporter(addr, walkerID, key string) *Reporter {
+	return &Reporter{
+		addr:     addr,
+		walkerID: walkerID,
+		key:      []byte(key),
+		notify:   make(chan struct{}, 1),
+		requests: make(chan *request),
+		done:     make(chan struct{}),
+	}
+}
+
+// Scan describes the current scan of the walker for ursus
+type Scan struct {
+	ID      string
+	Targets string
+	Ports   string
+	Rate    uint32
+}
+
+// SetScan sets the scan reported with heartbeats. Its id is sent along with the proxies reported from now on.
+func (r *Reporter) SetScan(scan Scan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scan = scan
+}
+
+func (r *Reporter) heartbeat() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.scan == (Scan{}) {
+		return nil
+	}
+	rate := ""
+	if r.scan.Rate != 0 {
+		rate = strconv.FormatUint(uint64(r.scan.Rate), 10)
+	}
+	return appendAttrs(nil, map[byte]string{
+		metaScanID:  r.scan.ID,
+		metaTargets: r.scan.Targets,
+		metaPorts:   r.scan.Ports,
+		metaRate:    rate,
+	})
+}
+
+// Report queues the proxy for sending to ursus. It never blocks on the network.
+// The metadata unknown to ursus is not reported.
+func (r *Reporter) Report(ip net.IP, port uint16, res banner.Result) error {
+	code, ok := protocols[res.Proto]
+	if !ok {
+		return errors.Errorf("protocol %s is not supported by ursus", res.Proto)
+	}
+	attrs := map[byte]string{
+		attrServer:   res.Server,
+		attrAuth:     strings.Join(res.Auth, ","),
+		attrVersion:  res.Version,
+		attrResponse: string(res.Response),
+	}
+	if res.RTT != 0 {
+		attrs[attrRTT] = strconv.FormatInt(res.RTT.Microseconds(), 10)
+	}
+	for name, v := range res.Meta {
+		if key, ok := metaAttributes[name]; ok {
+			attrs[key] = v
+		}
+	}
+	r.mu.Lock()
+	if len(r.pending) >= maxPending {
+		r.mu.Unlock()
+		return errors.New("too many proxies are waiting for ursus, dropping")
+	}
+	r.pending = append(r.pending, proxy{ip, port, code, attrs})
+	r.mu.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run maintains the connection until ctx is cancelled, reconnecting with a backoff on errors.
+// When ctx is done the proxies queued so far are flushed over the current connection before returning.
+func (r *Reporter) Run(ctx context.Context) {
+	defer close(r.done)
+	backoff := time.Second
+	for {
+		conn, err := net.DialTimeout("tcp", r.addr, ioTimeout)
+		if err == nil {
+			log.Printf("connected to ursus at %s", r.addr)
+			backoff = time.Second
+			err = r.serve(ctx, conn)
+			_ = conn.Close()
+			if err == nil {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			log.Printf("ursus is unreachable, %d proxies were not reported", r.Pending())
+			return
+		}
+		log.Printf("ursus connection error: %v, reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Done is closed when Run returns.
+func (r *Reporter) Done() <-chan struct{} {
+	return r.done
+}
+
+// Pending returns the number of proxies that have not been acknowledged by ursus yet.
+func (r *Reporter) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+func (r *Reporter) serve(ctx context.Context, conn net.Conn) error {
+	rd := bufio.NewReader(conn)
+	if err := r.authenticate(conn, rd); err != nil {
+		return errors.Wrap(err, "authentication failed")
+	}
+	hb := time.NewTicker(heartbeatInterval)
+	defer hb.Stop()
+	for {
+		if err := r.flush(conn, rd); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return r.flush(conn, rd)
+		case <-r.notify:
+		case req := <-r.requests:
+			ack, err := exchange(conn, rd, req.kind, req.payload, req.ackKind)
+			req.resp <- response{ack, err}
+			if err != nil {
+				return err
+			}
+		case <-hb.C:
+			if _, err := exchange(conn, rd, frameHeartbeat, r.heartbeat(), frameHeartbeatAck); err != nil {
+				return errors.Wrap(err, "heartbeat failed")
+			}
+		}
+	}
+}
+
+// authenticate says hello and answers the challenge if ursus sends one
+func (r *Reporter) authenticate(conn net.Conn, rd *bufio.Reader) error {
+	if err := conn.SetDeadline(time.Now().Add(ioTimeout)); err != nil {
+		return err
+	}
+	if err := writeFrame(conn, frameHello, appendAttrs(nil, map[byte]string{metaWalkerID: r.walkerID})); err != nil {
+		return err
+	}
+	f, err := readFrame(rd)
+	if err != nil {
+		return err
+	}
+	switch f.kind {
+	case frameAuthOk:
+		return nil
+	case frameChallenge:
+		if len(r.key) == 0 {
+			return errors.New("ursus requires a key")
+		}
+		_, err = exchange(conn, rd, frameAuth, mac(r.key, f.payload, r.walkerID), frameAuthOk)
+		return err
+	default:
+		return errors.Errorf("unexpected frame %#x", f.kind)
+	}
+}
+
+func mac(key, nonce []byte, walkerID string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(nonce)
+	h.Write([]byte(walkerID))
+	return h.Sum(nil)
+}
+
+// flush sends pending proxies in batches and removes each batch after ursus acknowledged it
+func (r *Reporter) flush(conn net.Conn, rd *bufio.Reader) error {
+	for {
+		r.mu.Lock()
+		cnt := len(r.pending)
+		if cnt == 0 {
+			r.mu.Unlock()
+			return nil
+		}
+		if cnt > maxBatch {
+			cnt = maxBatch
+		}
+		r.batchID++
+		id := r.batchID
+		payload := encodeBatch(id, map[byte]string{
+			metaScanID:   r.scan.ID,
+			metaWalkerID: r.walkerID,
+		}, r.pending[:cnt])
+		r.mu.Unlock()
+
+		ack, err := exchange(conn, rd, frameBatch, payload, frameBatchAck)
+		if err != nil {
+			return errors.Wrapf(err, "failed to report a batch of %d proxies", cnt)
+		}
+		ackID, saved, err := decodeBatchAck(ack)
+		if err != nil {
+			return err
+		}
+		if ackID != id {
+			return errors.Errorf("ack for the batch %d received instead of %d", ackID, id)
+		}
+		if int(saved) != cnt {
+			log.Printf("ursus saved %d of %d reported proxies", saved, cnt)
+		}
+
+		r.mu.Lock()
+		r.pending = r.pending[cnt:]
+		r.mu.Unlock()
+	}
+}
+
+// exchange writes the frame and waits for the ack frame, returning its payload
+func exchange(conn net.Conn, rd *bufio.Reader, kind byte, payload []byte, ackKind byte) ([]byte, error) {
+	if err := conn.SetDeadline(time.Now().Add(ioTimeout)); err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, kind, payload); err != nil {
+		return nil, err
+	}
+	ack, err := readFrame(rd)
+	if err != nil {
+		return nil, err
+	}
+	if ack.kind != ackKind {
+		return nil, errors.Errorf("unexpected ack frame %#x", ack.kind)
+	}
+	return ack.payload, nil
+}
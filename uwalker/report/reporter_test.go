@@ -0,0 +1,342 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"uwalker/banner"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUrsus mimics the v2 control server: acks every heartbeat and batch frame
+type fakeUrsus struct {
+	l   net.Listener
+	key []byte
+
+	mu         sync.Mutex
+	received   []proxy
+	meta       map[byte]string
+	heartbeats [][]byte
+	shards     []map[byte]string
+	done       []string
+	conns      []net.Conn
+}
+
+func newFakeUrsus(t *testing.T, addr string) *fakeUrsus {
+	l, err := net.Listen("tcp4", addr)
+	require.NoError(t, err)
+	f := &fakeUrsus{l: l}
+	go f.accept()
+	return f
+}
+
+func (f *fakeUrsus) accept() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, conn)
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeUrsus) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		fr, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		switch fr.kind {
+		case frameHello:
+			if f.key == nil {
+				err = writeFrame(conn, frameAuthOk, nil)
+				break
+			}
+			nonce := []byte("0123456789abcdef0123456789abcdef")
+			if err = writeFrame(conn, frameChallenge, nonce); err != nil {
+				return
+			}
+			if fr, err = readFrame(conn); err != nil || !bytes.Equal(fr.payload, mac(f.key, nonce, "w-1")) {
+				return
+			}
+			err = writeFrame(conn, frameAuthOk, nil)
+		case frameShardRequest:
+			var payload []byte
+			f.mu.Lock()
+			if len(f.shards) > 0 {
+				payload = appendAttrs(nil, f.shards[0])
+				f.shards = f.shards[1:]
+			}
+			f.mu.Unlock()
+			err = writeFrame(conn, frameShard, payload)
+		case frameShardDone:
+			attrs, _ := decodeAttrs(fr.payload)
+			f.mu.Lock()
+			f.done = append(f.done, attrs[metaShardID])
+			f.mu.Unlock()
+			err = writeFrame(conn, frameShardDoneAck, nil)
+		case frameHeartbeat:
+			f.mu.Lock()
+			f.heartbeats = append(f.heartbeats, fr.payload)
+			f.mu.Unlock()
+			err = writeFrame(conn, frameHeartbeatAck, nil)
+		case frameBatch:
+			id, meta, proxies := decodeBatch(fr.payload)
+			f.mu.Lock()
+			f.meta = meta
+			f.received = append(f.received, proxies...)
+			f.mu.Unlock()
+			ack := []byte{0, 0, 0, 0, byte(len(proxies) >> 8), byte(len(proxies))}
+			binary.BigEndian.PutUint32(ack, id)
+			err = writeFrame(conn, frameBatchAck, ack)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func decodeBatch(payload []byte) (uint32, map[byte]string, []proxy) {
+	id := binary.BigEndian.Uint32(payload)
+	meta := make(map[byte]string)
+	pos := 5
+	for i := 0; i < int(payload[4]); i++ {
+		l := int(binary.BigEndian.Uint16(payload[pos+1:]))
+		meta[payload[pos]] = string(payload[pos+3 : pos+3+l])
+		pos += 3 + l
+	}
+	cnt := int(binary.BigEndian.Uint16(payload[pos:]))
+	pos += 2
+	var res []proxy
+	for i := 0; i < cnt; i++ {
+		l := int(payload[pos+1])
+		p := proxy{
+			proto: payload[pos],
+			ip:    net.IP(payload[pos+2 : pos+2+l]),
+			port:  binary.BigEndian.Uint16(payload[pos+2+l:]),
+		}
+		pos += 2 + l + 2
+		cnt := int(payload[pos])
+		pos++
+		for j := 0; j < cnt; j++ {
+			if p.attrs == nil {
+				p.attrs = make(map[byte]string)
+			}
+			l := int(binary.BigEndian.Uint16(payload[pos+1:]))
+			p.attrs[payload[pos]] = string(payload[pos+3 : pos+3+l])
+			pos += 3 + l
+		}
+		res = append(res, p)
+	}
+	return id, meta, res
+}
+
+// dropConnections closes the accepted connections, imitating an ursus restart
+func (f *fakeUrsus) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		_ = c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeUrsus) messages() []proxy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]proxy(nil), f.received...)
+}
+
+func (f *fakeUrsus) Close() {
+	_ = f.l.Close()
+	f.dropConnections()
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReporter_Report(t *testing.T) {
+	u := newFakeUrsus(t, "127.0.0.1:0")
+	defer u.Close()
+
+	r := NewReporter(u.l.Addr().String(), "w-1", "")
+	r.SetScan(Scan{ID: "s1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.Run(ctx)
+
+	require.NoError(t, r.Report(net.ParseIP("184.181.217.210"), 4145, banner.Result{Proto: "socks5", Auth: []string{"password"}}))
+	require.NoError(t, r.Report(net.ParseIP("2001:db8::1"), 3128, banner.Result{
+		Proto:   "http",
+		Version: "1.1",
+		Server:  "squid",
+		Meta:    map[string]string{"via": "1.1 squid", "title": "unknown"},
+		RTT:     1500 * time.Microsecond,
+	}))
+	assert.Error(t, r.Report(net.ParseIP("10.1.2.3"), 1080, banner.Result{Proto: "gopher"}))
+
+	waitFor(t, func() bool { return len(u.messages()) == 2 })
+	assert.Equal(t, []proxy{
+		{net.IP{184, 181, 217, 210}, 4145, 0x1, map[byte]string{0x3: "password"}},
+		{net.ParseIP("2001:db8::1"), 3128, 0x4, map[byte]string{0x1: "squid", 0x2: "1.1 squid", 0x4: "1.1", 0x6: "1500"}},
+	}, u.messages())
+	assert.Equal(t, map[byte]string{metaScanID: "s1", metaWalkerID: "w-1"}, u.meta)
+	assert.Equal(t, 0, r.Pending())
+
+	cancel()
+	<-r.Done()
+}
+
+func TestReporter_Reconnect(t *testing.T) {
+	u := newFakeUrsus(t, "127.0.0.1:0")
+	addr := u.l.Addr().String()
+
+	r := NewReporter(addr, "w-1", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	require.NoError(t, r.Report(net.ParseIP("1.1.1.1"), 1080, banner.Result{Proto: "socks5"}))
+	waitFor(t, func() bool { return len(u.messages()) == 1 })
+
+	// ursus goes down, proxies must be buffered meanwhile
+	u.Close()
+	require.NoError(t, r.Report(net.ParseIP("2.2.2.2"), 1080, banner.Result{Proto: "socks5"}))
+	require.NoError(t, r.Report(net.ParseIP("3.3.3.3"), 1080, banner.Result{Proto: "socks5"}))
+
+	restarted := newFakeUrsus(t, addr)
+	defer restarted.Close()
+	waitFor(t, func() bool { return len(restarted.messages()) == 2 })
+	assert.Equal(t, net.IP{2, 2, 2, 2}, restarted.messages()[0].ip)
+	assert.Equal(t, net.IP{3, 3, 3, 3}, restarted.messages()[1].ip)
+}
+
+func TestReporter_FlushOnStop(t *testing.T) {
+	u := newFakeUrsus(t, "127.0.0.1:0")
+	defer u.Close()
+
+	r := NewReporter(u.l.Addr().String(), "w-1", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.Run(ctx)
+	waitFor(t, func() bool {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return len(u.conns) == 1
+	})
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, r.Report(net.IPv4(5, 5, byte(i>>8), byte(i)), 1080, banner.Result{Proto: "socks5"}))
+	}
+	cancel()
+	<-r.Done()
+	assert.Len(t, u.messages(), 1000)
+}
+
+func TestReporter_Authenticate(t *testing.T) {
+	u := newFakeUrsus(t, "127.0.0.1:0")
+	u.key = []byte("secret")
+	defer u.Close()
+
+	r := NewReporter(u.l.Addr().String(), "w-1", "secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.Run(ctx)
+	require.NoError(t, r.Report(net.ParseIP("1.1.1.1"), 1080, banner.Result{Proto: "socks5"}))
+	waitFor(t, func() bool { return len(u.messages()) == 1 })
+	cancel()
+	<-r.Done()
+
+	rejected := NewReporter(u.l.Addr().String(), "w-1", "guess")
+	ctx, cancel = context.WithCancel(context.Background())
+	go rejected.Run(ctx)
+	require.NoError(t, rejected.Report(net.ParseIP("2.2.2.2"), 1080, banner.Result{Proto: "socks5"}))
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-rejected.Done()
+	assert.Len(t, u.messages(), 1)
+	assert.Equal(t, 1, rejected.Pending())
+}
+
+func TestReporter_Heartbeat(t *testing.T) {
+	u := newFakeUrsus(t, "127.0.0.1:0")
+	defer u.Close()
+
+	r := NewReporter(u.l.Addr().String(), "w-1", "")
+	r.SetScan(Scan{ID: "s1", Ports: "1080", Rate: 100})
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.Run(ctx)
+	waitFor(t, func() bool {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return len(u.heartbeats) > 0
+	})
+	cancel()
+	<-r.Done()
+	assert.Equal(t, []byte{
+		0x03,
+		0x01, 0x00, 0x02, 's', '1',
+		0x04, 0x00, 0x04, '1', '0', '8', '0',
+		0x05, 0x00, 0x03, '1', '0', '0',
+	}, u.heartbeats[0])
+}
+
+func TestReporter_Shards(t *testing.T) {
+	u := newFakeUrsus(t, "127.0.0.1:0")
+	defer u.Close()
+	u.shards = []map[byte]string{{
+		metaScanID:  "job-1",
+		metaShardID: "job-1-0",
+		metaTargets: "10.0.0.0/24,10.1.0.0/24",
+		metaPorts:   "1080",
+		metaRate:    "50",
+	}}
+
+	r := NewReporter(u.l.Addr().String(), "w-1", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// requests wait for the connection
+	shards := make(chan *Shard)
+	go func() {
+		shard, err := r.NextShard(ctx)
+		assert.NoError(t, err)
+		shards <- shard
+	}()
+	go r.Run(ctx)
+
+	assert.Equal(t, &Shard{
+		ID:      "job-1-0",
+		Scan:    "job-1",
+		Targets: []string{"10.0.0.0/24", "10.1.0.0/24"},
+		Ports:   "1080",
+		Rate:    50,
+	}, <-shards)
+	require.NoError(t, r.ShardDone(ctx, "job-1-0"))
+	assert.Equal(t, []string{"job-1-0"}, u.done)
+
+	shard, err := r.NextShard(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, shard)
+
+	// the shard with an invalid rate is reported with its id to be completed
+	u.mu.Lock()
+	u.shards = []map[byte]string{{metaShardID: "job-1-1", metaTargets: "10.2.0.0/24", metaRate: "fast"}}
+	u.mu.Unlock()
+	_, err = r.NextShard(ctx)
+	require.IsType(t, &InvalidShardError{}, err)
+	assert.Equal(t, "job-1-1", err.(*InvalidShardError).ID)
+}
@@ -0,0 +1,94 @@
+package report
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// Shard is a part of a scan job dispatched by ursus
+type Shard struct {
+	ID      string
+	Scan    string
+	Targets []string
+	Ports   string
+	Rate    uint32
+}
+
+// InvalidShardError is returned for a shard that can't be scanned. The shard fails on any walker, so it's completed
+// to leave the queue, unless its ID can't be decoded.
+type InvalidShardError struct {
+	ID  string
+	Err error
+}
+
+func (e *InvalidShardError) Error() string {
+	return e.Err.Error()
+}
+
+// request is an exchange with ursus performed on behalf of the caller over the current connection
+type request struct {
+	kind    byte
+	payload []byte
+	ackKind byte
+	resp    chan response
+}
+
+type response struct {
+	payload []byte
+	err     error
+}
+
+// NextShard asks ursus for a shard to scan. It returns nil if ursus has nothing to scan.
+// The request waits for the connection to ursus to be established.
+func (r *Reporter) NextShard(ctx context.Context) (*Shard, error) {
+	payload, err := r.do(ctx, frameShardRequest, nil, frameShard)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	attrs, err := decodeAttrs(payload)
+	if err != nil {
+		return nil, &InvalidShardError{Err: errors.Wrap(err, "malformed shard")}
+	}
+	rate, err := strconv.ParseUint(attrs[metaRate], 10, 32)
+	if err != nil {
+		return nil, &InvalidShardError{attrs[metaShardID], errors.Wrap(err, "malformed shard rate")}
+	}
+	if attrs[metaShardID] == "" || attrs[metaTargets] == "" {
+		return nil, &InvalidShardError{attrs[metaShardID], errors.New("shard without id or targets")}
+	}
+	return &Shard{
+		ID:      attrs[metaShardID],
+		Scan:    attrs[metaScanID],
+		Targets: strings.Split(attrs[metaTargets], ","),
+		Ports:   attrs[metaPorts],
+		Rate:    uint32(rate),
+	}, nil
+}
+
+// ShardDone tells ursus that the shard is scanned
+func (r *Reporter) ShardDone(ctx context.Context, id string) error {
+	_, err := r.do(ctx, frameShardDone, appendAttrs(nil, map[byte]string{metaShardID: id}), frameShardDoneAck)
+	return err
+}
+
+func (r *Reporter) do(ctx context.Context, kind byte, payload []byte, ackKind byte) ([]byte, error) {
+	req := &request{kind, payload, ackKind, make(chan response, 1)}
+	select {
+	case r.requests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.done:
+		return nil, errors.New("reporter is stopped")
+	}
+	select {
+	case resp := <-req.resp:
+		return resp.payload, resp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,62 @@
+package scan
+
+import (
+	"context"
+	"sync"
+)
+
+// maxPending bounds the packets waiting for the consumer, the rest are dropped like in a full capture buffer
+const maxPending = 1 << 16
+
+// batcher passes packets from the receiving routines to the consumer without blocking them.
+// The consumer gets everything accumulated while it was busy as a single batch.
+type batcher struct {
+	mu      sync.Mutex
+	pending []*Packet
+	limit   int
+	ready   chan struct{}
+}
+
+// newBatcher creates a batcher keeping at most limit packets, zero means no limit
+func newBatcher(limit int) *batcher {
+	return &batcher{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// add queues the packet, it returns false if the packet is dropped
+func (b *batcher) add(p *Packet) bool {
+	b.mu.Lock()
+	if b.limit > 0 && len(b.pending) >= b.limit {
+		b.mu.Unlock()
+		return false
+	}
+	b.pending = append(b.pending, p)
+	b.mu.Unlock()
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// run delivers the batches until the ctx is done
+func (b *batcher) run(ctx context.Context, out chan<- []*Packet) {
+	for {
+		select {
+		case <-b.ready:
+		case <-ctx.Done():
+			return
+		}
+		b.mu.Lock()
+		batch := b.pending
+		b.pending = nil
+		b.mu.Unlock()
+		if len(batch) == 0 {
+			continue
+		}
+		select {
+		case out <- batch:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
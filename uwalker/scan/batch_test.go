@@ -0,0 +1,34 @@
+package scan
+
+import (
+	"context"
+	"testing"
+)
+
+func Test_batcher(t *testing.T) {
+	b := newBatcher(2)
+	for i := uint32(0); i < 3; i++ {
+		if ok := b.add(&Packet{Seq: i}); ok != (i < 2) {
+			t.Errorf("add(%d) = %v", i, ok)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan []*Packet)
+	done := make(chan struct{})
+	go func() {
+		b.run(ctx, out)
+		close(done)
+	}()
+	// the packets accumulated while the consumer was away come in a single batch
+	if batch := <-out; len(batch) != 2 || batch[0].Seq != 0 || batch[1].Seq != 1 {
+		t.Errorf("run() = %v", batch)
+	}
+	if !b.add(&Packet{Seq: 3}) {
+		t.Error("add() dropped a packet after the delivery")
+	}
+	if batch := <-out; len(batch) != 1 || batch[0].Seq != 3 {
+		t.Errorf("run() = %v", batch)
+	}
+	cancel()
+	<-done
+}
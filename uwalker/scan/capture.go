@@ -0,0 +1,106 @@
+package scan
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// the sent and the received frames are told apart by the interfaces of the capture
+const (
+	sentInterface = iota
+	receivedInterface
+)
+
+// recorder is a link writing the frames it passes to a pcapng capture
+type recorder struct {
+	link
+
+	mu sync.Mutex
+	// w is nil once the recording is stopped or failed
+	w *pcapgo.NgWriter
+}
+
+func newRecorder(l link, w io.Writer, iface, route, comment string) (*recorder, error) {
+	intf := pcapgo.NgInterface{
+		Name:                iface,
+		Description:         "frames sent by the scanner",
+		Comment:             route,
+		OS:                  runtime.GOOS,
+		LinkType:            layers.LinkTypeEthernet,
+		TimestampResolution: 9,
+	}
+	ng, err := pcapgo.NewNgWriterInterface(w, intf, pcapgo.NgWriterOptions{SectionInfo: pcapgo.NgSectionInfo{
+		Hardware:    runtime.GOARCH,
+		OS:          runtime.GOOS,
+		Application: "uwalker",
+		Comment:     comment,
+	}})
+	if err != nil {
+		return nil, errors.Wrap(err, "error writing the capture header")
+	}
+	intf.Description = "frames received by the scanner"
+	if _, err := ng.AddInterface(intf); err != nil {
+		return nil, errors.Wrap(err, "error writing the capture header")
+	}
+	return &recorder{link: l, w: ng}, nil
+}
+
+func (r *recorder) readPacket() ([]byte, error) {
+	data, err := r.link.readPacket()
+	if err == nil {
+		r.record(receivedInterface, data)
+	}
+	return data, err
+}
+
+func (r *recorder) writePacket(data []byte) error {
+	if err := r.link.writePacket(data); err != nil {
+		return err
+	}
+	r.record(sentInterface, data)
+	return nil
+}
+
+// record writes the frame, the recording is stopped on the first error not to fail the scan
+func (r *recorder) record(intf int, data []byte) {
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data), InterfaceIndex: intf}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	if err := r.w.WritePacket(ci, data); err != nil {
+		log.Printf("capture is stopped: %v", err)
+		r.w = nil
+	}
+}
+
+// stop stops the recording and flushes the capture
+func (r *recorder) stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	r.w = nil
+	return err
+}
+
+// Record writes the frames sent and received from now on to w in the pcapng format, the comment describes the scan.
+// It must be called before probing, the returned function stops the recording and flushes the capture.
+func (s *scanner) Record(w io.Writer, comment string) (func() error, error) {
+	r, err := newRecorder(s.link, w, s.iface.Name, s.String(), comment)
+	if err != nil {
+		return nil, err
+	}
+	s.link = r
+	return r.stop, nil
+}
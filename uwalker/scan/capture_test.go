@@ -0,0 +1,70 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func Test_scanner_Record(t *testing.T) {
+	probed, other := net.IP{184, 181, 217, 210}, net.IP{1, 1, 1, 1}
+	l := &fakeLink{frames: make(chan []byte, 10)}
+	for _, f := range [][]byte{
+		arpFrame(t),
+		tcpFrame(t, probed, scannerSrcPort, layers.TCP{SYN: true, ACK: true, Seq: 7, Ack: 1}, nil),
+		tcpFrame(t, other, scannerSrcPort, layers.TCP{SYN: true, ACK: true, Ack: 1}, nil),
+		tcpFrame(t, probed, scannerSrcPort, layers.TCP{ACK: true, Seq: 8, Ack: 6}, []byte{5, 0}),
+	} {
+		l.frames <- f
+	}
+	s := &scanner{
+		iface:       &net.Interface{Name: "eth0", HardwareAddr: localHw},
+		src:         net.IP{10, 0, 0, 1},
+		link:        l,
+		cookies:     testCookies,
+		tx:          testCookies.hash(),
+		buf:         gopacket.NewSerializeBuffer(),
+		opts:        gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		tcpTemplate: createTemplate(localHw, routerHw, net.IP{10, 0, 0, 1}),
+	}
+	var capture bytes.Buffer
+	stop, err := s.Record(&capture, "test scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Probe(probed, 1080); err != nil {
+		t.Fatal(err)
+	}
+	for range [4]struct{}{} {
+		if _, err := s.link.readPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReplay(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Comment() != "test scan" {
+		t.Errorf("Comment() = %q", r.Comment())
+	}
+	var got []*Packet
+	for batch := range r.Packets(context.Background()) {
+		got = append(got, batch...)
+	}
+	// the reply of the host that was not probed in the capture is rejected
+	if len(got) != 2 || !got[0].Start || !got[0].Addr.Equal(probed) || got[0].Seq != 7 || got[0].Ack != 1 ||
+		string(got[1].Data) != string([]byte{5, 0}) || got[1].Ack != 6 {
+		t.Errorf("Packets() = %+v", got)
+	}
+	if st := r.Stats(); st != (Stats{Received: 4, Invalid: 1}) {
+		t.Errorf("Stats() = %+v", st)
+	}
+}
@@ -0,0 +1,235 @@
+package scan
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type connKey struct {
+	ip   string
+	port uint16
+}
+
+// Connector probes targets with ordinary connect() calls, so it needs neither libpcap nor raw sockets.
+// It emulates the packets of the raw scanner: an established connection is reported as a SYN-ACK
+// with the sequence numbers starting at zero, every read as a data packet and a closed connection as a FIN.
+type Connector struct {
+	dialer  net.Dialer
+	timeout time.Duration
+	// slots bounds the number of the connections open at once
+	slots chan struct{}
+
+	mu      sync.Mutex
+	conns   map[connKey]*tcpConn
+	session *session
+}
+
+// session delivers the packets to a single Packets call
+type session struct {
+	packets *batcher
+	done    chan struct{}
+}
+
+func newSession() *session {
+	// the connections are bounded, so are their packets
+	return &session{packets: newBatcher(0), done: make(chan struct{})}
+}
+
+func (s *session) emit(p *Packet) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return s.packets.add(p)
+	}
+}
+
+type tcpConn struct {
+	*session
+	conn net.Conn
+	addr net.IP
+	port uint16
+
+	// sent is the sequence of the next byte to write, recv of the next byte to read
+	sent, recv uint32
+	release    sync.Once
+	closed     bool
+}
+
+// NewConnector creates a backend keeping at most size connections open.
+// Connections idle for the timeout are closed to free the slots.
+func NewConnector(size int, timeout time.Duration) *Connector {
+	return &Connector{
+		dialer:  net.Dialer{Timeout: timeout},
+		timeout: timeout,
+		slots:   make(chan struct{}, size),
+		conns:   make(map[connKey]*tcpConn),
+		session: newSession(),
+	}
+}
+
+// ErrBusy is returned by Probe while all the slots are taken
+var ErrBusy = errors.New("all the connections are busy")
+
+// Busy tells whether all the slots are taken, the callers wait with the probes until it's false
+func (c *Connector) Busy() bool {
+	return len(c.slots) == cap(c.slots)
+}
+
+// Probe dials the target in the background, it fails with ErrBusy instead of waiting for a free slot
+func (c *Connector) Probe(dst net.IP, port uint16) error {
+	c.mu.Lock()
+	s := c.session
+	c.mu.Unlock()
+	select {
+	case <-s.done:
+		return errors.New("connector is stopped")
+	default:
+	}
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		return ErrBusy
+	}
+	go c.dial(s, dst, port)
+	return nil
+}
+
+func (c *Connector) dial(s *session, dst net.IP, port uint16) {
+	conn, err := c.dialer.Dial("tcp", net.JoinHostPort(dst.String(), strconv.Itoa(int(port))))
+	if err != nil {
+		<-c.slots // closed or filtered, nothing to report just like for unanswered SYNs
+		return
+	}
+	t := &tcpConn{session: s, conn: conn, addr: dst, port: port, sent: 1, recv: 1}
+	k := connKey{dst.String(), port}
+	c.mu.Lock()
+	if old, ok := c.conns[k]; ok {
+		c.close(old)
+	}
+	c.conns[k] = t
+	c.mu.Unlock()
+	if !t.emit(&Packet{Addr: dst, Port: port, Start: true, Seq: 0, Ack: 1}) {
+		c.terminate(k, t)
+		return
+	}
+	c.read(k, t)
+}
+
+// read reports the received data until the connection is closed by any side
+func (c *Connector) read(k connKey, t *tcpConn) {
+	buf := make([]byte, 4096)
+	for {
+		_ = t.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := t.conn.Read(buf)
+		if n > 0 {
+			c.mu.Lock()
+			p := &Packet{Addr: t.addr, Port: t.port, Seq: t.recv, Ack: t.sent, Data: append([]byte(nil), buf[:n]...)}
+			t.recv += uint32(n)
+			c.mu.Unlock()
+			if !t.emit(p) {
+				c.terminate(k, t)
+				return
+			}
+		}
+		if err != nil {
+			c.mu.Lock()
+			closed := t.closed
+			p := &Packet{Addr: t.addr, Port: t.port, Done: true, Seq: t.recv, Ack: t.sent}
+			c.mu.Unlock()
+			c.terminate(k, t)
+			if !closed {
+				t.emit(p)
+			}
+			return
+		}
+	}
+}
+
+// ProbeData writes the part of the data that is not written yet
+func (c *Connector) ProbeData(dst net.IP, port uint16, seq, ack uint32, data []byte) error {
+	c.mu.Lock()
+	t, ok := c.conns[connKey{dst.String(), port}]
+	if !ok {
+		c.mu.Unlock()
+		return nil // closed meanwhile, the data would be dropped by the party as well
+	}
+	end := seq + uint32(len(data))
+	if seq > t.sent || end <= t.sent {
+		c.mu.Unlock()
+		return nil
+	}
+	data = data[t.sent-seq:]
+	t.sent = end
+	c.mu.Unlock()
+
+	_ = t.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if _, err := t.conn.Write(data); err != nil {
+		_ = t.conn.Close() // the reading routine reports the connection closed
+		return errors.Wrapf(err, "error writing to %s:%d", dst, port)
+	}
+	return nil
+}
+
+// Terminate resets the connection
+func (c *Connector) Terminate(dst net.IP, port uint16, seq uint32) error {
+	k := connKey{dst.String(), port}
+	c.mu.Lock()
+	t, ok := c.conns[k]
+	c.mu.Unlock()
+	if ok {
+		c.terminate(k, t)
+	}
+	return nil
+}
+
+func (c *Connector) terminate(k connKey, t *tcpConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[k] == t {
+		delete(c.conns, k)
+	}
+	c.close(t)
+}
+
+// close closes the connection and frees its slot, c.mu must be held
+func (c *Connector) close(t *tcpConn) {
+	t.closed = true
+	if tc, ok := t.conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0) // RST instead of FIN, the proxies are not waited for
+	}
+	_ = t.conn.Close()
+	t.release.Do(func() { <-c.slots })
+}
+
+// Packets returns the emulated packets of the connections opened after the call in batches,
+// the connections are closed once the ctx is done
+func (c *Connector) Packets(ctx context.Context) <-chan []*Packet {
+	s := newSession()
+	c.mu.Lock()
+	c.session = s
+	c.mu.Unlock()
+	out := make(chan []*Packet)
+	go func() {
+		s.packets.run(ctx, out)
+		c.stop(s)
+		close(out)
+	}()
+	return out
+}
+
+func (c *Connector) stop(s *session) {
+	close(s.done)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, t := range c.conns {
+		if t.session == s {
+			delete(c.conns, k)
+			c.close(t)
+		}
+	}
+}
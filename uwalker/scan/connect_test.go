@@ -0,0 +1,145 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, serve func(conn net.Conn)) (net.IP, uint16) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP, uint16(addr.Port)
+}
+
+// flatten passes the packets of the batches one by one
+func flatten(batches <-chan []*Packet) <-chan *Packet {
+	out := make(chan *Packet)
+	go func() {
+		defer close(out)
+		for batch := range batches {
+			for _, p := range batch {
+				out <- p
+			}
+		}
+	}()
+	return out
+}
+
+func nextPacket(t *testing.T, packets <-chan *Packet) *Packet {
+	select {
+	case p := <-packets:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("no packet")
+		return nil
+	}
+}
+
+func TestConnector(t *testing.T) {
+	ip, port := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		_, _ = conn.Write(bytes.ToUpper(buf))
+	})
+	c := NewConnector(1, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	packets := flatten(c.Packets(ctx))
+
+	if err := c.Probe(ip, port); err != nil {
+		t.Fatal(err)
+	}
+	if p := nextPacket(t, packets); !p.Start || p.Seq != 0 || p.Ack != 1 || !p.Addr.Equal(ip) || p.Port != port {
+		t.Fatalf("Packets() = %+v, want SYN-ACK", p)
+	}
+	// the data is written once, retransmitted bytes are skipped
+	if err := c.ProbeData(ip, port, 1, 1, []byte("hel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ProbeData(ip, port, 1, 1, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if p := nextPacket(t, packets); p.Seq != 1 || p.Ack != 6 || string(p.Data) != "HELLO" {
+		t.Fatalf("Packets() = %+v, want the data", p)
+	}
+	if p := nextPacket(t, packets); !p.Done || p.Seq != 6 {
+		t.Fatalf("Packets() = %+v, want FIN", p)
+	}
+
+	// the slot of the closed connection is free again
+	if err := c.Probe(ip, port); err != nil {
+		t.Fatal(err)
+	}
+	if p := nextPacket(t, packets); !p.Start {
+		t.Fatalf("Packets() = %+v, want SYN-ACK", p)
+	}
+	if err := c.Terminate(ip, port, 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-packets:
+		t.Fatalf("Packets() = %+v after the termination", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	if _, ok := <-packets; ok {
+		t.Error("Packets() is not closed")
+	}
+	if err := c.Probe(ip, port); err == nil {
+		t.Error("Probe() succeeded after the stop")
+	}
+}
+
+func TestConnector_refused(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	_ = l.Close()
+
+	c := NewConnector(1, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	packets := flatten(c.Packets(ctx))
+	for i := 0; i < 3; i++ {
+		// the slot would stay busy if the failed probes kept it
+		for deadline := time.Now().Add(time.Second); c.Busy(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Busy() after the refused connection")
+			}
+		}
+		if err := c.Probe(addr.IP, uint16(addr.Port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Probe(addr.IP, uint16(addr.Port)); err != nil && err != ErrBusy {
+		t.Errorf("Probe() = %v, want nil or ErrBusy", err)
+	}
+	select {
+	case p := <-packets:
+		t.Fatalf("Packets() = %+v for a closed port", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,51 @@
+package scan
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"net"
+)
+
+// maxAcked bounds the acknowledged bytes of a connection, acks beyond it don't belong to the probes
+const maxAcked = 1 << 16
+
+// cookies derive the initial sequence numbers and the source ports of the probes from a keyed hash
+// of their targets, so replies are validated without any state. Every scanner has its own key,
+// so the scanners sharing a host reject the replies to each other.
+type cookies struct {
+	seed maphash.Seed
+	// the source ports are picked from [first, first+count)
+	first, count uint16
+}
+
+func newCookies(first, count uint16) cookies {
+	return cookies{seed: maphash.MakeSeed(), first: first, count: count}
+}
+
+// cookieHash computes the cookies of a single routine
+type cookieHash struct {
+	cookies
+	h maphash.Hash
+}
+
+func (c cookies) hash() *cookieHash {
+	h := &cookieHash{cookies: c}
+	h.h.SetSeed(c.seed)
+	return h
+}
+
+// of returns the initial sequence number and the source port of the probes to the target
+func (c *cookieHash) of(ip net.IP, port uint16) (uint32, uint16) {
+	c.h.Reset()
+	_, _ = c.h.Write(ip.To16())
+	var p [2]byte
+	binary.BigEndian.PutUint16(p[:], port)
+	_, _ = c.h.Write(p[:])
+	sum := c.h.Sum64()
+	return uint32(sum), c.first + uint16((sum>>32)%uint64(c.count))
+}
+
+// ours tells whether the port is in the range of the source ports
+func (c *cookieHash) ours(port uint16) bool {
+	return port >= c.first && port-c.first < c.count
+}
@@ -0,0 +1,33 @@
+package scan
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_cookies(t *testing.T) {
+	c := newCookies(40000, 100)
+	h := c.hash()
+	ip := net.ParseIP("184.181.217.210")
+	isn, port := h.of(ip, 1080)
+	if isn2, port2 := c.hash().of(ip.To4(), 1080); isn2 != isn || port2 != port {
+		t.Errorf("of() = %d %d for the same target, want %d %d", isn2, port2, isn, port)
+	}
+	if isn2, _ := newCookies(40000, 100).hash().of(ip, 1080); isn2 == isn {
+		t.Error("of() of another key is the same")
+	}
+	ports := make(map[uint16]bool)
+	for p := uint16(0); p < 1000; p++ {
+		_, port := h.of(ip, p)
+		if !h.ours(port) {
+			t.Fatalf("of() = port %d out of the range", port)
+		}
+		ports[port] = true
+	}
+	if len(ports) < 90 {
+		t.Errorf("of() used %d of 100 source ports", len(ports))
+	}
+	if h.ours(39999) || h.ours(40100) {
+		t.Error("ours() accepted a port out of the range")
+	}
+}
@@ -0,0 +1,121 @@
+package scan
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+	"net"
+	"sync/atomic"
+)
+
+var (
+	errUnexpectedPort = errors.New("unexpected dst port")
+	errInvalidCookie  = errors.New("ack doesn't match the probe")
+)
+
+// Stats counts the frames received by a scanner
+type Stats struct {
+	Received   uint64
+	Malformed  uint64
+	Unexpected uint64
+	// Invalid are the packets not acknowledging the probes, backscatter or replies to another scanner
+	Invalid uint64
+	// Dropped are the packets not taken by the conductor in time
+	Dropped uint64
+}
+
+// count counts the frame by the error of its decoding
+func (s *Stats) count(err error) {
+	atomic.AddUint64(&s.Received, 1)
+	switch err {
+	case nil:
+	case errUnexpectedPort:
+		atomic.AddUint64(&s.Unexpected, 1)
+	case errInvalidCookie:
+		atomic.AddUint64(&s.Invalid, 1)
+	default:
+		atomic.AddUint64(&s.Malformed, 1)
+	}
+}
+
+func (s *Stats) load() Stats {
+	return Stats{
+		Received:   atomic.LoadUint64(&s.Received),
+		Malformed:  atomic.LoadUint64(&s.Malformed),
+		Unexpected: atomic.LoadUint64(&s.Unexpected),
+		Invalid:    atomic.LoadUint64(&s.Invalid),
+		Dropped:    atomic.LoadUint64(&s.Dropped),
+	}
+}
+
+// issuer tells the initial sequence numbers and the source ports of the probes to the targets
+type issuer interface {
+	of(ip net.IP, port uint16) (uint32, uint16)
+	ours(port uint16) bool
+}
+
+// decoder parses the frames into the preallocated layers, nothing is allocated for the ignored frames
+type decoder struct {
+	eth layers.Ethernet
+	ip4 layers.IPv4
+	ip6 layers.IPv6
+	tcp layers.TCP
+
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+	cookies issuer
+}
+
+func newDecoder(c issuer) *decoder {
+	d := &decoder{decoded: make([]gopacket.LayerType, 0, 4), cookies: c}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &d.eth, &d.ip4, &d.ip6, &d.tcp)
+	// arp and icmpv6 frames are captured for the neighbor resolution, they are just not decoded further
+	d.parser.IgnoreUnsupported = true
+	return d
+}
+
+// decode returns the TCP packet of the frame or nil for the other frames.
+// The packet doesn't reference the frame data, so the frame buffer can be reused.
+// Packets must acknowledge the sequence of the probe, the ack is made relative to it then.
+func (d *decoder) decode(data []byte) (*Packet, error) {
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil {
+		return nil, err
+	}
+	var src net.IP
+	tcp := false
+	for _, t := range d.decoded {
+		switch t {
+		case layers.LayerTypeIPv4:
+			src = d.ip4.SrcIP
+		case layers.LayerTypeIPv6:
+			src = d.ip6.SrcIP
+		case layers.LayerTypeTCP:
+			tcp = true
+		}
+	}
+	if src == nil || !tcp {
+		return nil, nil
+	}
+	if !d.cookies.ours(uint16(d.tcp.DstPort)) {
+		return nil, errUnexpectedPort
+	}
+	isn, port := d.cookies.of(src, uint16(d.tcp.SrcPort))
+	acked := d.tcp.Ack - isn
+	// resets without ack can't be validated, the connections time out instead
+	if port != uint16(d.tcp.DstPort) || !d.tcp.ACK || acked == 0 || acked > maxAcked || (d.tcp.SYN && acked != 1) {
+		return nil, errInvalidCookie
+	}
+	var payload []byte
+	if len(d.tcp.Payload) > 0 {
+		payload = append([]byte(nil), d.tcp.Payload...)
+	}
+	return &Packet{
+		Addr:  append(net.IP(nil), src...),
+		Port:  uint16(d.tcp.SrcPort),
+		Done:  d.tcp.RST || d.tcp.FIN,
+		Start: d.tcp.SYN && d.tcp.ACK,
+		Seq:   d.tcp.Seq,
+		Ack:   acked,
+		Data:  payload,
+	}, nil
+}
@@ -0,0 +1,214 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const scannerSrcPort = 55324
+
+// testCookies are used by the scanners of the tests, the acks of the frames are made relative to them
+var testCookies = newCookies(scannerSrcPort, 1)
+
+func tcpFrame(t testing.TB, src net.IP, dstPort layers.TCPPort, tcp layers.TCP, payload []byte) []byte {
+	return cookieFrame(t, testCookies, src, dstPort, tcp, payload)
+}
+
+func cookieFrame(t testing.TB, c cookies, src net.IP, dstPort layers.TCPPort, tcp layers.TCP, payload []byte) []byte {
+	eth := &layers.Ethernet{SrcMAC: routerHw, DstMAC: localHw, EthernetType: layers.EthernetTypeIPv4}
+	var ip networkLayer = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: net.IP{10, 0, 0, 1}}
+	if src.To4() == nil {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: src, DstIP: local6}
+	}
+	tcp.SrcPort, tcp.DstPort = 1080, dstPort
+	if tcp.ACK {
+		isn, _ := c.hash().of(src, 1080)
+		tcp.Ack += isn
+	}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, &tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func arpFrame(t testing.TB) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{},
+		&layers.Ethernet{SrcMAC: routerHw, DstMAC: localHw, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			Operation: layers.ARPReply, SourceHwAddress: routerHw, SourceProtAddress: []byte{10, 0, 0, 254},
+			DstHwAddress: localHw, DstProtAddress: []byte{10, 0, 0, 1},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test_decoder_decode(t *testing.T) {
+	synAck := tcpFrame(t, net.IP{184, 181, 217, 210}, scannerSrcPort, layers.TCP{SYN: true, ACK: true, Seq: 7, Ack: 1}, nil)
+	tests := []struct {
+		name    string
+		frame   []byte
+		want    *Packet
+		wantErr error
+	}{
+		{"syn-ack", synAck, &Packet{Addr: net.IP{184, 181, 217, 210}, Port: 1080, Start: true, Seq: 7, Ack: 1}, nil},
+		{"ipv6 data",
+			tcpFrame(t, net.ParseIP("2001:db8::1"), scannerSrcPort, layers.TCP{ACK: true, PSH: true, Seq: 8, Ack: 4}, []byte{5, 0}),
+			&Packet{Addr: net.ParseIP("2001:db8::1"), Port: 1080, Seq: 8, Ack: 4, Data: []byte{5, 0}}, nil},
+		{"rst", tcpFrame(t, net.IP{1, 1, 1, 1}, scannerSrcPort, layers.TCP{RST: true, ACK: true, Seq: 9, Ack: 1}, nil),
+			&Packet{Addr: net.IP{1, 1, 1, 1}, Port: 1080, Done: true, Seq: 9, Ack: 1}, nil},
+		{"arp", arpFrame(t), nil, nil},
+		{"unexpected port", tcpFrame(t, net.IP{1, 1, 1, 1}, 80, layers.TCP{SYN: true, ACK: true, Ack: 1}, nil), nil, errUnexpectedPort},
+		{"syn-ack with wrong ack", tcpFrame(t, net.IP{1, 1, 1, 1}, scannerSrcPort, layers.TCP{SYN: true, ACK: true, Ack: 2}, nil), nil, errInvalidCookie},
+		{"data beyond the sent bytes", tcpFrame(t, net.IP{1, 1, 1, 1}, scannerSrcPort, layers.TCP{ACK: true, Ack: maxAcked + 1}, []byte{1}), nil, errInvalidCookie},
+		{"rst without ack", tcpFrame(t, net.IP{1, 1, 1, 1}, scannerSrcPort, layers.TCP{RST: true}, nil), nil, errInvalidCookie},
+		{"syn-ack to another scanner",
+			cookieFrame(t, newCookies(scannerSrcPort, 1), net.IP{1, 1, 1, 1}, scannerSrcPort, layers.TCP{SYN: true, ACK: true, Ack: 1}, nil),
+			nil, errInvalidCookie},
+	}
+	d := newDecoder(testCookies.hash())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.decode(tt.frame)
+			if err != tt.wantErr {
+				t.Fatalf("decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("decode() = %+v, want %+v", got, tt.want)
+			}
+			if got != nil && (!got.Addr.Equal(tt.want.Addr) || got.Port != tt.want.Port || got.Start != tt.want.Start ||
+				got.Done != tt.want.Done || got.Seq != tt.want.Seq || got.Ack != tt.want.Ack || string(got.Data) != string(tt.want.Data)) {
+				t.Errorf("decode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := d.decode(synAck[:40]); err == nil {
+		t.Error("decode() accepted a truncated tcp header")
+	}
+	// the packet doesn't keep the frame data
+	frame := append([]byte(nil), synAck...)
+	p, _ := d.decode(frame)
+	for i := range frame {
+		frame[i] = 0
+	}
+	if !p.Addr.Equal(net.IP{184, 181, 217, 210}) {
+		t.Errorf("decode() packet references the frame, addr = %v", p.Addr)
+	}
+
+	arp := arpFrame(t)
+	if allocs := testing.AllocsPerRun(100, func() { _, _ = d.decode(arp) }); allocs != 0 {
+		t.Errorf("decode() of an ignored frame allocates %v times", allocs)
+	}
+}
+
+// fakeLink returns the frames and then times out
+type fakeLink struct {
+	frames chan []byte
+}
+
+func (l *fakeLink) readPacket() ([]byte, error) {
+	select {
+	case f := <-l.frames:
+		return f, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, errTimeout
+	}
+}
+
+func (l *fakeLink) writePacket(data []byte) error {
+	return nil
+}
+
+func (l *fakeLink) close() error {
+	return nil
+}
+
+func Test_scanner_Packets(t *testing.T) {
+	synAck := tcpFrame(t, net.IP{184, 181, 217, 210}, scannerSrcPort, layers.TCP{SYN: true, ACK: true, Ack: 1}, nil)
+	l := &fakeLink{frames: make(chan []byte, 10)}
+	for _, f := range [][]byte{
+		synAck,
+		arpFrame(t),
+		synAck[:40],
+		tcpFrame(t, net.IP{1, 1, 1, 1}, 80, layers.TCP{SYN: true, ACK: true, Ack: 1}, nil),
+		tcpFrame(t, net.IP{1, 1, 1, 1}, scannerSrcPort, layers.TCP{SYN: true, ACK: true, Ack: 7}, nil),
+		tcpFrame(t, net.IP{184, 181, 217, 210}, scannerSrcPort, layers.TCP{ACK: true, Seq: 1, Ack: 4}, []byte{5, 0}),
+	} {
+		l.frames <- f
+	}
+	s := &scanner{link: l, cookies: testCookies}
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := flatten(s.Packets(ctx))
+	if p := nextPacket(t, packets); !p.Start {
+		t.Errorf("Packets() = %+v, want SYN-ACK", p)
+	}
+	if p := nextPacket(t, packets); string(p.Data) != string([]byte{5, 0}) {
+		t.Errorf("Packets() = %+v, want data", p)
+	}
+	for deadline := time.Now().Add(time.Second); s.Stats().Received != 6; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats() = %+v", s.Stats())
+		}
+	}
+	if st := s.Stats(); st != (Stats{Received: 6, Malformed: 1, Unexpected: 1, Invalid: 1}) {
+		t.Errorf("Stats() = %+v", st)
+	}
+	cancel()
+	if _, ok := <-packets; ok {
+		t.Error("Packets() is not closed")
+	}
+}
+
+// blockingLink blocks the reads until the release
+type blockingLink struct {
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (l *blockingLink) readPacket() ([]byte, error) {
+	select {
+	case l.reading <- struct{}{}:
+	default:
+	}
+	<-l.release
+	return nil, errTimeout
+}
+
+func (l *blockingLink) writePacket(data []byte) error {
+	return nil
+}
+
+func (l *blockingLink) close() error {
+	return nil
+}
+
+func Test_scanner_PacketsWaitsForReceiver(t *testing.T) {
+	l := &blockingLink{reading: make(chan struct{}, 1), release: make(chan struct{})}
+	s := &scanner{link: l, cookies: testCookies}
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := s.Packets(ctx)
+	<-l.reading
+	cancel()
+	select {
+	case <-packets:
+		t.Fatal("Packets() is closed while the receiver reads")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(l.release)
+	if _, ok := <-packets; ok {
+		t.Error("Packets() is not closed")
+	}
+}
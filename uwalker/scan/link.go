@@ -0,0 +1,81 @@
+package scan
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+// errTimeout is returned by links when no frame arrives in time, the readers check for cancellation then
+var errTimeout = errors.New("read timeout")
+
+// readTimeout bounds the waiting for an incoming frame
+const readTimeout = 5 * time.Second
+
+// link sends and receives raw ethernet frames of an interface
+type link interface {
+	// readPacket returns the next incoming frame, the data is valid until the next call
+	readPacket() ([]byte, error)
+	writePacket(data []byte) error
+	// close releases the link, it must not be called while a frame is read
+	close() error
+}
+
+// opener opens a link delivering the incoming frames matching the BPF filter
+type opener func(iface *net.Interface, filter string) (link, error)
+
+type pcapLink struct {
+	handle *pcap.Handle
+}
+
+func openPcap(iface *net.Interface, filter string) (link, error) {
+	handle, err := pcap.NewInactiveHandle(iface.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetPromisc(true); err != nil {
+		return nil, err
+	}
+	if err := handle.SetTimeout(readTimeout); err != nil {
+		return nil, err
+	}
+	if err := handle.SetSnapLen(65536); err != nil {
+		return nil, err
+	}
+	l := &pcapLink{}
+	if l.handle, err = handle.Activate(); err != nil {
+		return nil, err
+	}
+	if err = l.handle.SetBPFFilter(filter); err != nil {
+		return nil, errors.Wrap(err, "error compiling incoming packets filter")
+	}
+	return l, nil
+}
+
+func (l *pcapLink) readPacket() ([]byte, error) {
+	data, _, err := l.handle.ZeroCopyReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		return nil, errTimeout
+	}
+	return data, err
+}
+
+func (l *pcapLink) writePacket(data []byte) error {
+	return l.handle.WritePacketData(data)
+}
+
+func (l *pcapLink) close() error {
+	l.handle.Close()
+	return nil
+}
+
+// openRingFilter compiles the filter with libpcap and opens the AF_PACKET rings
+func openRingFilter(iface *net.Interface, filter string) (link, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65536, filter)
+	if err != nil {
+		return nil, errors.Wrap(err, "error compiling incoming packets filter")
+	}
+	return openRing(iface, instructions)
+}
@@ -0,0 +1,66 @@
+package scan
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// solicitedNode returns the solicited-node multicast address of the ip and its MAC
+func solicitedNode(ip net.IP) (net.IP, net.HardwareAddr) {
+	ip = ip.To16()
+	group := net.ParseIP("ff02::1:ff00:0")
+	copy(group[13:], ip[13:])
+	return group, net.HardwareAddr{0x33, 0x33, 0xff, ip[13], ip[14], ip[15]}
+}
+
+// neighborSolicitation builds the NDP request of the target MAC, the IPv6 counterpart of an ARP request
+func neighborSolicitation(srcHw net.HardwareAddr, src, target net.IP) []gopacket.SerializableLayer {
+	group, groupHw := solicitedNode(target)
+	eth := &layers.Ethernet{
+		SrcMAC:       srcHw,
+		DstMAC:       groupHw,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{
+		Version:    6,
+		SrcIP:      src,
+		DstIP:      group,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+	_ = icmp.SetNetworkLayerForChecksum(ip6)
+	ns := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: target,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: srcHw},
+		},
+	}
+	return []gopacket.SerializableLayer{eth, ip6, icmp, ns}
+}
+
+// neighborAdvertisement returns the target MAC if the packet is the NDP reply about the target.
+// The MAC is copied, the packet may reference the reused buffer of the link.
+func neighborAdvertisement(packet gopacket.Packet, target net.IP) net.HardwareAddr {
+	l := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement)
+	if l == nil {
+		return nil
+	}
+	na := l.(*layers.ICMPv6NeighborAdvertisement)
+	if !na.TargetAddress.Equal(target) {
+		return nil
+	}
+	for _, o := range na.Options {
+		if o.Type == layers.ICMPv6OptTargetAddress && len(o.Data) >= 6 {
+			return append(net.HardwareAddr(nil), o.Data[:6]...)
+		}
+	}
+	// solicited advertisements may omit the option, the sender is the target then
+	if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok {
+		return append(net.HardwareAddr(nil), eth.SrcMAC...)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package scan
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	localHw  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	routerHw = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	local6   = net.ParseIP("2001:db8::10")
+	router6  = net.ParseIP("fe80::1:2:3")
+)
+
+func serialize(t *testing.T, l ...gopacket.SerializableLayer) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func Test_solicitedNode(t *testing.T) {
+	ip, hw := solicitedNode(router6)
+	if !ip.Equal(net.ParseIP("ff02::1:ff02:3")) {
+		t.Errorf("solicitedNode() ip = %v", ip)
+	}
+	if hw.String() != "33:33:ff:02:00:03" {
+		t.Errorf("solicitedNode() hw = %v", hw)
+	}
+}
+
+func Test_neighborSolicitation(t *testing.T) {
+	p := serialize(t, neighborSolicitation(localHw, local6, router6)...)
+	if err := p.ErrorLayer(); err != nil {
+		t.Fatal(err.Error())
+	}
+	ip6 := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ip6.DstIP.Equal(net.ParseIP("ff02::1:ff02:3")) || ip6.HopLimit != 255 {
+		t.Errorf("neighborSolicitation() ip = %v, hop limit %d", ip6.DstIP, ip6.HopLimit)
+	}
+	ns, ok := p.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if !ok {
+		t.Fatal("neighborSolicitation() is not a neighbor solicitation")
+	}
+	if !ns.TargetAddress.Equal(router6) || len(ns.Options) != 1 || net.HardwareAddr(ns.Options[0].Data).String() != localHw.String() {
+		t.Errorf("neighborSolicitation() = %v", ns)
+	}
+}
+
+func advertisement(t *testing.T, target net.IP, options layers.ICMPv6Options) gopacket.Packet {
+	ip6 := &layers.IPv6{Version: 6, SrcIP: router6, DstIP: local6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+	_ = icmp.SetNetworkLayerForChecksum(ip6)
+	return serialize(t,
+		&layers.Ethernet{SrcMAC: routerHw, DstMAC: localHw, EthernetType: layers.EthernetTypeIPv6},
+		ip6,
+		icmp,
+		&layers.ICMPv6NeighborAdvertisement{Flags: 0x60, TargetAddress: target, Options: options},
+	)
+}
+
+func Test_neighborAdvertisement(t *testing.T) {
+	announced := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}
+	tests := []struct {
+		name   string
+		packet gopacket.Packet
+		want   net.HardwareAddr
+	}{
+		{"target option", advertisement(t, router6, layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: announced}}), announced},
+		{"no option", advertisement(t, router6, nil), routerHw},
+		{"other target", advertisement(t, local6, nil), nil},
+		{"solicitation", serialize(t, neighborSolicitation(routerHw, router6, local6)...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := neighborAdvertisement(tt.packet, router6); got.String() != tt.want.String() {
+				t.Errorf("neighborAdvertisement() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_neighborAdvertisement_copy(t *testing.T) {
+	announced := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}
+	for name, want := range map[string]net.HardwareAddr{"target option": announced, "no option": routerHw} {
+		t.Run(name, func(t *testing.T) {
+			var options layers.ICMPv6Options
+			if name == "target option" {
+				options = layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: announced}}
+			}
+			frame := append([]byte(nil), advertisement(t, router6, options).Data()...)
+			got := neighborAdvertisement(gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy), router6)
+			// the link reuses the buffer for the next frames
+			for i := range frame {
+				frame[i] = 0xff
+			}
+			if got.String() != want.String() {
+				t.Errorf("neighborAdvertisement() = %v after the buffer is reused, want %v", got, want)
+			}
+		})
+	}
+}
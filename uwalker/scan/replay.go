@@ -0,0 +1,130 @@
+package scan
+
+import (
+	"context"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+)
+
+// Replay delivers the packets received in a capture recorded by a scanner and sends nothing.
+// The cookies of the scanner are gone with it, so the replies are validated against the SYNs of the capture.
+type Replay struct {
+	r     *pcapgo.NgReader
+	stats Stats
+}
+
+func NewReplay(r io.Reader) (*Replay, error) {
+	ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading the capture")
+	}
+	if ng.LinkType() != layers.LinkTypeEthernet {
+		return nil, errors.Errorf("unsupported link type %s of the capture", ng.LinkType())
+	}
+	return &Replay{r: ng}, nil
+}
+
+// Comment returns the description of the recorded scan
+func (r *Replay) Comment() string {
+	return r.r.SectionInfo().Comment
+}
+
+func (r *Replay) Probe(dst net.IP, port uint16) error {
+	return nil
+}
+
+func (r *Replay) ProbeData(dst net.IP, port uint16, seq, ack uint32, data []byte) error {
+	return nil
+}
+
+func (r *Replay) Terminate(dst net.IP, port uint16, seq uint32) error {
+	return nil
+}
+
+// Packets delivers the received packets one by one in the recorded order, the channel is closed at the end of the capture
+func (r *Replay) Packets(ctx context.Context) <-chan []*Packet {
+	out := make(chan []*Packet)
+	go func() {
+		defer close(out)
+		probes := &recordedProbes{cookies: make(map[connKey]recordedCookie), ports: make(map[uint16]bool)}
+		d := newDecoder(probes)
+		for ctx.Err() == nil {
+			data, ci, err := r.r.ZeroCopyReadPacketData()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("error reading the capture: %v", err)
+				break
+			}
+			if ci.InterfaceIndex == sentInterface {
+				probes.add(d, data)
+				continue
+			}
+			p, err := d.decode(data)
+			r.stats.count(err)
+			if p == nil {
+				continue
+			}
+			select {
+			case out <- []*Packet{p}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		st := r.Stats()
+		log.Printf("replay finished: %d frames received, %d malformed, %d unexpected, %d invalid",
+			st.Received, st.Malformed, st.Unexpected, st.Invalid)
+	}()
+	return out
+}
+
+// Stats returns the counters of the replayed frames
+func (r *Replay) Stats() Stats {
+	return r.stats.load()
+}
+
+type recordedCookie struct {
+	isn  uint32
+	port uint16
+}
+
+// recordedProbes issues the cookies of the SYNs sent in the capture
+type recordedProbes struct {
+	cookies map[connKey]recordedCookie
+	ports   map[uint16]bool
+}
+
+// add registers the cookie of the frame if it's a SYN
+func (p *recordedProbes) add(d *decoder, data []byte) {
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil {
+		return
+	}
+	var dst net.IP
+	for _, t := range d.decoded {
+		switch t {
+		case layers.LayerTypeIPv4:
+			dst = d.ip4.DstIP
+		case layers.LayerTypeIPv6:
+			dst = d.ip6.DstIP
+		case layers.LayerTypeTCP:
+			if dst != nil && d.tcp.SYN && !d.tcp.ACK {
+				k := connKey{dst.String(), uint16(d.tcp.DstPort)}
+				p.cookies[k] = recordedCookie{d.tcp.Seq, uint16(d.tcp.SrcPort)}
+				p.ports[uint16(d.tcp.SrcPort)] = true
+			}
+		}
+	}
+}
+
+func (p *recordedProbes) of(ip net.IP, port uint16) (uint32, uint16) {
+	c := p.cookies[connKey{ip.String(), port}]
+	return c.isn, c.port
+}
+
+func (p *recordedProbes) ours(port uint16) bool {
+	return p.ports[port]
+}
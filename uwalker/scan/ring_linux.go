@@ -0,0 +1,236 @@
+//go:build linux
+// +build linux
+
+package scan
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/pcap"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	ringBlockSize = 1 << 20
+	ringFrameSize = 2048
+	rxBlocks      = 32
+	txBlocks      = 8
+	txFrames      = ringBlockSize / ringFrameSize * txBlocks
+	// rxRetire is the time in milliseconds after which a partially filled block is passed to the reader
+	rxRetire = 10
+	// txBatch frames are queued before the kernel is asked to send them,
+	// the queued frames are sent after txFlush at the latest
+	txBatch = 64
+	txFlush = time.Millisecond
+	// txOffset is where the frame data follows the header in the TX ring slots
+	txOffset = (unix.SizeofTpacket3Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+	// blockHeader is the offset of the block header in the block descriptor
+	blockHeader = 8
+)
+
+// ring is the link on the memory-mapped TPACKET_V3 rings of an AF_PACKET socket
+type ring struct {
+	fd     int
+	mem    []byte
+	rx, tx []byte
+
+	// block is the RX block being read, it is returned to the kernel once all its packets are read
+	block     int
+	held      bool
+	remaining uint32
+	next      int
+
+	mu      sync.Mutex
+	frame   int
+	pending int
+	done    chan struct{}
+}
+
+func openRing(iface *net.Interface, filter []pcap.BPFInstruction) (link, error) {
+	// the socket receives nothing until it is bound, so no frame escapes the filter
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating AF_PACKET socket")
+	}
+	r := &ring{fd: fd, done: make(chan struct{})}
+	if err := r.setup(iface, filter); err != nil {
+		if r.mem != nil {
+			_ = unix.Munmap(r.mem)
+		}
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	go r.flusher()
+	return r, nil
+}
+
+func (r *ring) setup(iface *net.Interface, filter []pcap.BPFInstruction) error {
+	if err := unix.SetsockoptInt(r.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return errors.Wrap(err, "error selecting TPACKET_V3")
+	}
+	rx := unix.TpacketReq3{
+		Block_size:     ringBlockSize,
+		Block_nr:       rxBlocks,
+		Frame_size:     ringFrameSize,
+		Frame_nr:       ringBlockSize / ringFrameSize * rxBlocks,
+		Retire_blk_tov: rxRetire,
+	}
+	if err := unix.SetsockoptTpacketReq3(r.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &rx); err != nil {
+		return errors.Wrap(err, "error creating RX ring")
+	}
+	tx := unix.TpacketReq3{
+		Block_size: ringBlockSize,
+		Block_nr:   txBlocks,
+		Frame_size: ringFrameSize,
+		Frame_nr:   txFrames,
+	}
+	if err := unix.SetsockoptTpacketReq3(r.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &tx); err != nil {
+		return errors.Wrap(err, "error creating TX ring")
+	}
+	// the probes don't need traffic shaping, older kernels just keep the qdisc
+	_ = unix.SetsockoptInt(r.fd, unix.SOL_PACKET, unix.PACKET_QDISC_BYPASS, 1)
+
+	rxSize, txSize := ringBlockSize*rxBlocks, ringBlockSize*txBlocks
+	mem, err := unix.Mmap(r.fd, 0, rxSize+txSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return errors.Wrap(err, "error mapping the rings")
+	}
+	r.mem, r.rx, r.tx = mem, mem[:rxSize], mem[rxSize:]
+
+	if len(filter) > 0 {
+		prog := make([]unix.SockFilter, len(filter))
+		for i, ins := range filter {
+			prog[i] = unix.SockFilter{Code: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+		}
+		fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+		if err := unix.SetsockoptSockFprog(r.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+			return errors.Wrap(err, "error attaching incoming packets filter")
+		}
+	}
+	err = unix.Bind(r.fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index})
+	return errors.Wrapf(err, "error binding to %s", iface.Name)
+}
+
+func (r *ring) readPacket() ([]byte, error) {
+	for {
+		if r.remaining > 0 {
+			h := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.rx[r.next]))
+			start := r.next + int(h.Mac)
+			r.next += int(h.Next_offset)
+			r.remaining--
+			return r.rx[start : start+int(h.Snaplen)], nil
+		}
+		if r.held {
+			atomic.StoreUint32(r.blockStatus(), unix.TP_STATUS_KERNEL)
+			r.block = (r.block + 1) % rxBlocks
+			r.held = false
+		}
+		if atomic.LoadUint32(r.blockStatus())&unix.TP_STATUS_USER == 0 {
+			fds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN | unix.POLLERR}}
+			n, err := unix.Poll(fds, int(readTimeout/time.Millisecond))
+			if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				return nil, errors.Wrap(err, "error polling RX ring")
+			}
+			if n == 0 {
+				return nil, errTimeout
+			}
+			continue
+		}
+		h := (*unix.TpacketHdrV1)(unsafe.Pointer(&r.rx[r.block*ringBlockSize+blockHeader]))
+		r.held = true
+		r.remaining = h.Num_pkts
+		r.next = r.block*ringBlockSize + int(h.Offset_to_first_pkt)
+	}
+}
+
+func (r *ring) blockStatus() *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.rx[r.block*ringBlockSize+blockHeader]))
+}
+
+// writePacket queues the frame in the TX ring, the frames are sent in batches
+func (r *ring) writePacket(data []byte) error {
+	if len(data) > ringFrameSize-txOffset {
+		return errors.Errorf("frame of %d bytes doesn't fit the ring", len(data))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	off := r.frame * ringFrameSize
+	h := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.tx[off]))
+	if atomic.LoadUint32(&h.Status)&(unix.TP_STATUS_SEND_REQUEST|unix.TP_STATUS_SENDING) != 0 {
+		// the ring is full, waiting for the kernel to send the queued frames
+		if err := r.flush(0); err != nil {
+			return err
+		}
+		if atomic.LoadUint32(&h.Status)&(unix.TP_STATUS_SEND_REQUEST|unix.TP_STATUS_SENDING) != 0 {
+			return errors.New("TX ring is full")
+		}
+	}
+	copy(r.tx[off+txOffset:], data)
+	h.Len = uint32(len(data))
+	h.Snaplen = uint32(len(data))
+	atomic.StoreUint32(&h.Status, unix.TP_STATUS_SEND_REQUEST)
+	r.frame = (r.frame + 1) % txFrames
+	r.pending++
+	if r.pending >= txBatch {
+		return r.flush(unix.MSG_DONTWAIT)
+	}
+	return nil
+}
+
+// flush asks the kernel to send the queued frames, r.mu must be held
+func (r *ring) flush(flags int) error {
+	// unix.Sendto doesn't accept a nil address
+	_, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(r.fd), 0, 0, uintptr(flags), 0, 0)
+	if errno == unix.EAGAIN || errno == unix.ENOBUFS {
+		return nil // the kernel is busy sending, the frames stay queued for the next flush
+	}
+	r.pending = 0
+	if errno != 0 {
+		return errors.Wrap(errno, "error sending TX ring")
+	}
+	return nil
+}
+
+func (r *ring) flusher() {
+	t := time.NewTicker(txFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.mu.Lock()
+			if r.pending > 0 {
+				_ = r.flush(unix.MSG_DONTWAIT)
+			}
+			r.mu.Unlock()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *ring) close() error {
+	close(r.done)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending > 0 {
+		_ = r.flush(0)
+	}
+	if err := unix.Munmap(r.mem); err != nil {
+		return err
+	}
+	return unix.Close(r.fd)
+}
+
+// htons converts the protocol to the network byte order expected in the host order fields
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
@@ -0,0 +1,57 @@
+package scan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestRing(t *testing.T) {
+	a, b := veth(t)
+	tx, err := openRing(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.(*ring).close()
+	rx, err := openRing(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.(*ring).close()
+
+	frames := make(map[string]bool)
+	for i := 0; i < 3*txBatch; i++ {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 99, 0, 1}, DstIP: net.IP{10, 99, 0, 2}}
+		tcp := &layers.TCP{SrcPort: scannerSrcPort, DstPort: layers.TCPPort(i), SYN: true}
+		_ = tcp.SetNetworkLayerForChecksum(ip)
+		p := serialize(t, &layers.Ethernet{SrcMAC: a.HardwareAddr, DstMAC: b.HardwareAddr, EthernetType: layers.EthernetTypeIPv4}, ip, tcp)
+		if err := tx.writePacket(p.Data()); err != nil {
+			t.Fatal(err)
+		}
+		frames[string(p.Data())] = true
+	}
+	// the frames of a partial batch are flushed as well
+	for deadline := time.Now().Add(5 * time.Second); len(frames) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames are not received", len(frames))
+		}
+		data, err := rx.readPacket()
+		if err == errTimeout {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		// the interfaces send their own ipv6 traffic as well
+		if bytes.Equal(data[:6], b.HardwareAddr) {
+			delete(frames, string(data))
+		}
+	}
+
+	big := make([]byte, ringFrameSize)
+	if err := tx.writePacket(big); err == nil {
+		t.Error("writePacket() accepted a frame larger than the ring slot")
+	}
+}
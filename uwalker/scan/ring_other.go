@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package scan
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/pkg/errors"
+	"net"
+)
+
+func openRing(iface *net.Interface, filter []pcap.BPFInstruction) (link, error) {
+	return nil, errors.New("AF_PACKET rings are supported on Linux only")
+}
@@ -0,0 +1,82 @@
+package scan
+
+import (
+	"github.com/google/gopacket/routing"
+	"github.com/pkg/errors"
+	"net"
+)
+
+// defaultRouteTarget is routed to find the interface, the source address and the gateway of the probes
+var defaultRouteTarget = net.IPv4(1, 1, 1, 1)
+
+// RouteOptions override the route of the probes for multi-homed hosts, policy routing and containers,
+// the zero values are looked up in the routing table
+type RouteOptions struct {
+	// Target is routed instead of 1.1.1.1
+	Target net.IP
+	// Iface is the interface to scan through
+	Iface string
+	Src   net.IP
+	// GatewayMAC is the MAC the probes are sent to, the gateway isn't resolved with ARP if it's set
+	GatewayMAC net.HardwareAddr
+}
+
+func (o RouteOptions) target() net.IP {
+	if o.Target == nil {
+		return defaultRouteTarget
+	}
+	return o.Target
+}
+
+// resolveRoute returns the interface, the IPv4 gateway and the source address of the probes.
+// The gateway is nil when the target is on the link.
+func resolveRoute(router routing.Router, o RouteOptions) (*net.Interface, net.IP, net.IP, error) {
+	target := o.target()
+	if target.To4() == nil {
+		return nil, nil, nil, errors.Errorf("route target %s is not an IPv4 address", target)
+	}
+	if o.Src != nil && o.Src.To4() == nil {
+		return nil, nil, nil, errors.Errorf("source %s is not an IPv4 address", o.Src)
+	}
+	iface, gw, src, err := router.Route(target)
+	if o.Iface != "" {
+		forced, ierr := net.InterfaceByName(o.Iface)
+		if ierr != nil {
+			return nil, nil, nil, errors.Wrapf(ierr, "error looking up the interface %s", o.Iface)
+		}
+		if err != nil || iface.Name != forced.Name {
+			// the gateway of another interface is unreachable, it must be given instead
+			if o.GatewayMAC == nil {
+				return nil, nil, nil, errors.Errorf("%s is not routed through %s, the gateway MAC must be set", target, forced.Name)
+			}
+			gw, src, err = nil, nil, nil
+		}
+		iface = forced
+	}
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "error routing %s", target)
+	}
+	if o.Src != nil {
+		src = o.Src
+	}
+	if src == nil {
+		if src, err = ifaceAddr4(iface); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return iface, gw, src.To4(), nil
+}
+
+// ifaceAddr4 returns the first IPv4 address of the interface
+func ifaceAddr4(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the addresses of %s", iface.Name)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP.To4(), nil
+		}
+	}
+	return nil, errors.Errorf("%s has no IPv4 address", iface.Name)
+}
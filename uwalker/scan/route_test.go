@@ -0,0 +1,68 @@
+package scan
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeRouter routes everything through the interface
+type fakeRouter struct {
+	iface   *net.Interface
+	gw, src net.IP
+	err     error
+}
+
+func (r fakeRouter) Route(dst net.IP) (*net.Interface, net.IP, net.IP, error) {
+	return r.iface, r.gw, r.src, r.err
+}
+
+func (r fakeRouter) RouteWithSrc(input net.HardwareAddr, src, dst net.IP) (*net.Interface, net.IP, net.IP, error) {
+	return r.Route(dst)
+}
+
+func Test_resolveRoute(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	other := &net.Interface{Index: 1000, Name: "other0"}
+	gw, src := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	tests := []struct {
+		name    string
+		router  fakeRouter
+		opts    RouteOptions
+		iface   string
+		gw, src net.IP
+	}{
+		{"routed", fakeRouter{iface: lo, gw: gw, src: src}, RouteOptions{}, "lo", gw, src},
+		{"source", fakeRouter{iface: lo, gw: gw, src: src}, RouteOptions{Src: net.IPv4(10, 0, 0, 3)}, "lo", gw, net.IPv4(10, 0, 0, 3)},
+		{"routed interface", fakeRouter{iface: lo, gw: gw, src: src}, RouteOptions{Iface: "lo"}, "lo", gw, src},
+		{"another interface", fakeRouter{iface: other, gw: gw, src: src}, RouteOptions{Iface: "lo", GatewayMAC: routerHw},
+			"lo", nil, net.IPv4(127, 0, 0, 1)},
+		{"unrouted interface", fakeRouter{err: errors.New("no route")}, RouteOptions{Iface: "lo", GatewayMAC: routerHw},
+			"lo", nil, net.IPv4(127, 0, 0, 1)},
+		{"another interface without gateway", fakeRouter{iface: other, gw: gw, src: src}, RouteOptions{Iface: "lo"}, "", nil, nil},
+		{"no route", fakeRouter{err: errors.New("no route")}, RouteOptions{}, "", nil, nil},
+		{"unknown interface", fakeRouter{iface: lo, gw: gw, src: src}, RouteOptions{Iface: "missing0"}, "", nil, nil},
+		{"ipv6 target", fakeRouter{iface: lo, gw: gw, src: src}, RouteOptions{Target: local6}, "", nil, nil},
+		{"ipv6 source", fakeRouter{iface: lo, gw: gw, src: src}, RouteOptions{Src: local6}, "", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iface, gw, src, err := resolveRoute(tt.router, tt.opts)
+			if tt.iface == "" {
+				if err == nil {
+					t.Fatalf("resolveRoute() = %v %v %v, want an error", iface, gw, src)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if iface.Name != tt.iface || !gw.Equal(tt.gw) || !src.Equal(tt.src) {
+				t.Errorf("resolveRoute() = %s %v %v, want %s %v %v", iface.Name, gw, src, tt.iface, tt.gw, tt.src)
+			}
+		})
+	}
+}
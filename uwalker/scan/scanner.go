@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/routing"
 	"github.com/pkg/errors"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,13 +24,21 @@ type Packet struct {
 }
 
 type scanner struct {
+	// stats is the first to keep the atomic counters aligned on 32-bit platforms
+	stats Stats
+
 	iface        *net.Interface
 	gw, src      net.IP
 	routerHwaddr net.HardwareAddr
+	// src6 is nil when there is no IPv6 route through the interface, no6 tells why
+	src6 net.IP
+	no6  error
 
-	srcPort uint16
+	// cookies validate the replies, tx computes them for the sent probes
+	cookies cookies
+	tx      *cookieHash
 
-	handle *pcap.Handle
+	link link
 
 	opts gopacket.SerializeOptions
 	buf  gopacket.SerializeBuffer
@@ -41,51 +49,110 @@ type scanner struct {
 type tcpTemplate struct {
 	eth layers.Ethernet
 	ip4 layers.IPv4
+
+	eth6 layers.Ethernet
+	ip6  layers.IPv6
+}
+
+// networkLayer is the IPv4 or IPv6 layer of the template
+type networkLayer interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}
+
+// PortRange is the range of the source ports of the probes, the kernel must drop the replies to them
+// instead of resetting the connections it doesn't know
+type PortRange struct {
+	First, Last uint16
+}
+
+// ipv6Probe is routed to find the interface address and the gateway used for IPv6 targets
+var ipv6Probe = net.ParseIP("2001:4860:4860::8888")
+
+// NewScanner creates a scanner sending and capturing packets with libpcap
+func NewScanner(router routing.Router, route RouteOptions, ports PortRange) (*scanner, error) {
+	return newScanner(router, route, ports, openPcap)
 }
 
-const scannerSrcPort = 55324
+// NewRingScanner creates a scanner on the memory-mapped AF_PACKET rings, it is faster than libpcap but Linux only
+func NewRingScanner(router routing.Router, route RouteOptions, ports PortRange) (*scanner, error) {
+	return newScanner(router, route, ports, openRingFilter)
+}
 
-func NewScanner(ip net.IP, router routing.Router) (*scanner, error) {
+func newScanner(router routing.Router, route RouteOptions, ports PortRange, open opener) (*scanner, error) {
+	if ports.First == 0 || ports.Last < ports.First {
+		return nil, errors.Errorf("invalid source port range %d-%d", ports.First, ports.Last)
+	}
 	s := &scanner{
 		opts: gopacket.SerializeOptions{
 			FixLengths:       true,
 			ComputeChecksums: true,
 		},
-		srcPort: scannerSrcPort,
+		cookies: newCookies(ports.First, ports.Last-ports.First+1),
 		buf:     gopacket.NewSerializeBuffer(),
 	}
-	iface, gw, src, err := router.Route(ip)
+	s.tx = s.cookies.hash()
+	iface, gw, src, err := resolveRoute(router, route)
 	if err != nil {
 		return nil, err
 	}
 	s.gw, s.src, s.iface = gw, src, iface
 
-	var handle *pcap.InactiveHandle
-	if handle, err = pcap.NewInactiveHandle(iface.Name); err != nil {
+	filter := fmt.Sprintf("(tcp and dst portrange %d-%d) or arp or (icmp6 and ip6[40] == %d)",
+		ports.First, ports.Last, layers.ICMPv6TypeNeighborAdvertisement)
+	if s.link, err = open(iface, filter); err != nil {
 		return nil, err
 	}
-	if err := handle.SetPromisc(true); err != nil {
-		return nil, err
+	if s.routerHwaddr = route.GatewayMAC; s.routerHwaddr == nil {
+		next := gw
+		if next == nil {
+			next = route.target() // the target itself is resolved when it's on the link
+		}
+		if s.routerHwaddr, err = s.getHwAddr(next); err != nil {
+			_ = s.link.close()
+			return nil, errors.Wrapf(err, "error obtaining the MAC of the router %s", next)
+		}
 	}
-	if err := handle.SetTimeout(5 * time.Second); err != nil {
-		return nil, err
+	s.tcpTemplate = createTemplate(s.iface.HardwareAddr, s.routerHwaddr, s.src)
+	if s.no6 = s.enableIPv6(router); s.no6 != nil {
+		log.Printf("IPv6 targets are disabled: %v", s.no6)
 	}
-	if err := handle.SetSnapLen(65536); err != nil {
-		return nil, err
+	return s, nil
+}
+
+// String describes the route of the probes
+func (s *scanner) String() string {
+	via := "on the link"
+	if s.gw != nil {
+		via = "via " + s.gw.String()
 	}
-	if s.handle, err = handle.Activate(); err != nil {
-		return nil, err
+	res := fmt.Sprintf("%s (%s) from %s %s (%s)", s.iface.Name, s.iface.HardwareAddr, s.src, via, s.routerHwaddr)
+	if s.src6 == nil {
+		return res + fmt.Sprintf(", IPv6 disabled: %v", s.no6)
+	}
+	return res + fmt.Sprintf(", IPv6 from %s via %s", s.src6, s.eth6.DstMAC)
+}
+
+// enableIPv6 resolves the IPv6 gateway of the scanning interface and fills the IPv6 template
+func (s *scanner) enableIPv6(router routing.Router) error {
+	iface, gw, src, err := router.Route(ipv6Probe)
+	if err != nil {
+		return err
 	}
-	if err = s.handle.SetBPFFilter(fmt.Sprintf("(tcp and dst port %d) or arp", scannerSrcPort)); err != nil {
-		return nil, errors.Wrap(err, "error compiling incoming packets filter")
+	if iface.Name != s.iface.Name {
+		return errors.Errorf("IPv6 is routed through %s instead of %s", iface.Name, s.iface.Name)
 	}
-	routerHwaddr, err := s.getHwAddr(gw)
+	if gw == nil {
+		// every on-link target would need its own MAC, while the template holds only the gateway's one
+		return errors.Errorf("IPv6 is on the link of %s without a gateway, the MACs of on-link targets are not resolved", iface.Name)
+	}
+	hwaddr, err := s.getNeighborHwAddr(src, gw)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error obtaining the MAC of the router %s", gw.String())
+		return errors.Wrapf(err, "error obtaining the MAC of the router %s", gw.String())
 	}
-	s.routerHwaddr = routerHwaddr
-	s.tcpTemplate = createTemplate(s.iface.HardwareAddr, s.routerHwaddr, s.src)
-	return s, nil
+	s.src6 = src
+	s.eth6, s.ip6 = createTemplate6(s.iface.HardwareAddr, hwaddr, src)
+	return nil
 }
 
 func createTemplate(srcHw, dstHw net.HardwareAddr, src net.IP) tcpTemplate {
@@ -104,121 +171,143 @@ func createTemplate(srcHw, dstHw net.HardwareAddr, src net.IP) tcpTemplate {
 	}
 }
 
-func (s *scanner) applyTemplate(dst net.IP) *tcpTemplate {
-	s.tcpTemplate.ip4.DstIP = dst.To4()
-	return &s.tcpTemplate
+func createTemplate6(srcHw, dstHw net.HardwareAddr, src net.IP) (layers.Ethernet, layers.IPv6) {
+	return layers.Ethernet{
+		SrcMAC:       srcHw,
+		DstMAC:       dstHw,
+		EthernetType: layers.EthernetTypeIPv6,
+	}, layers.IPv6{
+		SrcIP:      src,
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolTCP,
+	}
+}
+
+// applyTemplate picks the layers of the destination family
+func (s *scanner) applyTemplate(dst net.IP) (*layers.Ethernet, networkLayer, error) {
+	if ip4 := dst.To4(); ip4 != nil {
+		s.tcpTemplate.ip4.DstIP = ip4
+		return &s.tcpTemplate.eth, &s.tcpTemplate.ip4, nil
+	}
+	if s.src6 == nil {
+		return nil, nil, errors.Errorf("no IPv6 route to %s: %v", dst, s.no6)
+	}
+	s.tcpTemplate.ip6.DstIP = dst
+	return &s.tcpTemplate.eth6, &s.tcpTemplate.ip6, nil
 }
 
 func (s *scanner) Terminate(dst net.IP, port uint16, seq uint32) error {
-	t := s.applyTemplate(dst)
+	eth, ip, err := s.applyTemplate(dst)
+	if err != nil {
+		return err
+	}
+	isn, srcPort := s.tx.of(dst, port)
 	tcp := layers.TCP{
-		SrcPort: layers.TCPPort(s.srcPort),
+		SrcPort: layers.TCPPort(srcPort),
 		DstPort: layers.TCPPort(port),
-		Seq:     seq,
+		Seq:     isn + seq,
 		RST:     true,
 	}
-	tcp.SetNetworkLayerForChecksum(&s.ip4)
-	if err := s.send(&t.eth, &t.ip4, &tcp); err != nil {
+	tcp.SetNetworkLayerForChecksum(ip)
+	if err := s.send(eth, ip, &tcp); err != nil {
 		return errors.Wrap(err, "error sending RST")
 	}
 	return nil
 }
 
 func (s *scanner) Probe(dst net.IP, port uint16) error {
-	t := s.applyTemplate(dst)
+	eth, ip, err := s.applyTemplate(dst)
+	if err != nil {
+		return err
+	}
+	isn, srcPort := s.tx.of(dst, port)
 	tcp := layers.TCP{
-		SrcPort: layers.TCPPort(s.srcPort),
+		SrcPort: layers.TCPPort(srcPort),
 		DstPort: layers.TCPPort(port),
 		Window:  200,
+		Seq:     isn,
 		SYN:     true,
 	}
-	tcp.SetNetworkLayerForChecksum(&s.ip4)
-	if err := s.send(&t.eth, &t.ip4, &tcp); err != nil {
+	tcp.SetNetworkLayerForChecksum(ip)
+	if err := s.send(eth, ip, &tcp); err != nil {
 		return errors.Wrap(err, "error sending SYN")
 	}
 	return nil
 }
 
 func (s *scanner) ProbeData(dst net.IP, port uint16, seq, ack uint32, data []byte) error {
-	t := s.applyTemplate(dst)
+	eth, ip, err := s.applyTemplate(dst)
+	if err != nil {
+		return err
+	}
+	isn, srcPort := s.tx.of(dst, port)
 	tcp := layers.TCP{
-		SrcPort: layers.TCPPort(s.srcPort),
+		SrcPort: layers.TCPPort(srcPort),
 		DstPort: layers.TCPPort(port),
 		Window:  200,
-		Seq:     seq,
+		Seq:     isn + seq,
 		Ack:     ack,
 		ACK:     true,
 		PSH:     true,
 	}
-	tcp.SetNetworkLayerForChecksum(&s.ip4)
-	if err := s.send(&t.eth, &t.ip4, &tcp, gopacket.Payload(data)); err != nil {
+	tcp.SetNetworkLayerForChecksum(ip)
+	if err := s.send(eth, ip, &tcp, gopacket.Payload(data)); err != nil {
 		return errors.Wrap(err, "error sending probe with data")
 	}
 	return nil
 }
 
-func (s *scanner) Packets(ctx context.Context) <-chan *Packet {
-	out := make(chan *Packet)
+// Packets returns the TCP packets sent to the scanner, they are delivered in batches.
+// The channel is closed after the receiver stops reading, so the receivers of the next calls don't share the link with it.
+func (s *scanner) Packets(ctx context.Context) <-chan []*Packet {
+	out := make(chan []*Packet)
+	b := newBatcher(maxPending)
+	stopped := make(chan struct{})
 	go func() {
-	loop:
-		for {
-			select {
-			case <-ctx.Done():
-				break loop
-			default:
-			}
-			data, _, err := s.handle.ZeroCopyReadPacketData()
-			if err == pcap.NextErrorTimeoutExpired {
+		b.run(ctx, out)
+		<-stopped
+		close(out)
+	}()
+	go func() {
+		defer close(stopped)
+		d := newDecoder(s.cookies.hash())
+		for ctx.Err() == nil {
+			data, err := s.link.readPacket()
+			if err == errTimeout {
 				continue
 			} else if err != nil {
 				log.Printf("error reading packet: %v", err)
 				continue
 			}
-
-			// Parse the packet.  We'd use DecodingLayerParser here if we
-			// wanted to be really fast.
-			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
-
-			// Find the packets we care about, and print out logging
-			// information about them.  All others are ignored.
-			if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer == nil {
-				// non ip packet
-			} else if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer == nil {
-				// not a tcp
-			} else if ip, ok := ipLayer.(*layers.IPv4); !ok {
-				panic("ip layer is not ip")
-			} else if tcp, ok := tcpLayer.(*layers.TCP); !ok {
-				panic("tcp layer is not tcp")
-			} else if tcp.DstPort != scannerSrcPort {
-				panic("unexpected dst port")
-			} else {
-				var tcpPayload []byte
-				if len(tcp.Payload) > 0 {
-					tcpPayload = make([]byte, len(tcp.Payload))
-					copy(tcpPayload, tcp.Payload)
-				}
-				out <- &Packet{
-					ip.SrcIP,
-					uint16(tcp.SrcPort),
-					tcp.RST || tcp.FIN,
-					tcp.SYN && tcp.ACK,
-					tcp.Seq,
-					tcp.Ack,
-					tcpPayload,
-				}
+			p, err := d.decode(data)
+			s.stats.count(err)
+			if p != nil && !b.add(p) {
+				atomic.AddUint64(&s.stats.Dropped, 1)
 			}
 		}
-		log.Println("receiver closed")
-		close(out)
+		st := s.Stats()
+		log.Printf("receiver closed: %d frames received, %d malformed, %d unexpected, %d invalid, %d packets dropped",
+			st.Received, st.Malformed, st.Unexpected, st.Invalid, st.Dropped)
 	}()
 	return out
 }
 
+// Close releases the link of the scanner, the packets of its Packets calls must be closed before
+func (s *scanner) Close() error {
+	return s.link.close()
+}
+
+// Stats returns the counters of the received frames
+func (s *scanner) Stats() Stats {
+	return s.stats.load()
+}
+
 func (s *scanner) send(l ...gopacket.SerializableLayer) error {
 	if err := gopacket.SerializeLayers(s.buf, s.opts, l...); err != nil {
 		return err
 	}
-	return s.handle.WritePacketData(s.buf.Bytes())
+	return s.link.writePacket(s.buf.Bytes())
 }
 
 func (s *scanner) getHwAddr(arpIpDst net.IP) (net.HardwareAddr, error) {
@@ -247,23 +336,45 @@ func (s *scanner) getHwAddr(arpIpDst net.IP) (net.HardwareAddr, error) {
 	if err := s.send(&eth, &arp); err != nil {
 		return nil, err
 	}
-	// Wait 3 seconds for an ARP reply.
+	return s.awaitHwAddr(start, func(packet gopacket.Packet) net.HardwareAddr {
+		if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+			arp := arpLayer.(*layers.ARP)
+			if net.IP(arp.SourceProtAddress).Equal(arpIpDst) {
+				return append(net.HardwareAddr(nil), arp.SourceHwAddress...)
+			}
+		}
+		return nil
+	})
+}
+
+// getNeighborHwAddr resolves the MAC of an IPv6 neighbor with the Neighbor Discovery Protocol
+func (s *scanner) getNeighborHwAddr(src, dst net.IP) (net.HardwareAddr, error) {
+	start := time.Now()
+	if err := s.send(neighborSolicitation(s.iface.HardwareAddr, src, dst)...); err != nil {
+		return nil, err
+	}
+	return s.awaitHwAddr(start, func(packet gopacket.Packet) net.HardwareAddr {
+		return neighborAdvertisement(packet, dst)
+	})
+}
+
+// awaitHwAddr reads packets until match finds the MAC in one of them.
+// The packets are decoded without copying the reused buffers of the link, match must return a copy of the MAC.
+func (s *scanner) awaitHwAddr(start time.Time, match func(gopacket.Packet) net.HardwareAddr) (net.HardwareAddr, error) {
+	// Wait 5 seconds for a reply.
 	for {
 		if time.Since(start) > time.Second*5 {
-			return nil, errors.New("timeout getting ARP reply")
+			return nil, errors.New("timeout getting the hardware address")
 		}
-		data, _, err := s.handle.ReadPacketData()
-		if err == pcap.NextErrorTimeoutExpired {
+		data, err := s.link.readPacket()
+		if err == errTimeout {
 			continue
 		} else if err != nil {
 			return nil, err
 		}
 		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
-		if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
-			arp := arpLayer.(*layers.ARP)
-			if net.IP(arp.SourceProtAddress).Equal(arpIpDst) {
-				return arp.SourceHwAddress, nil
-			}
+		if hwaddr := match(packet); hwaddr != nil {
+			return hwaddr, nil
 		}
 	}
 }
@@ -2,7 +2,13 @@ package scan
 
 import (
 	"context"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"net"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
 	"time"
 	"uwalker/limiter"
@@ -32,6 +38,65 @@ func Test_scanner_Probe(t *testing.T) {
 	}
 }
 
+func Test_scanner_applyTemplate(t *testing.T) {
+	s := &scanner{tcpTemplate: createTemplate(localHw, routerHw, net.IPv4(10, 0, 0, 1).To4())}
+	eth, ip, err := s.applyTemplate(net.ParseIP("184.181.217.210"))
+	if err != nil || eth.EthernetType != layers.EthernetTypeIPv4 || ip.NetworkFlow().Dst() != layers.NewIPEndpoint(net.IPv4(184, 181, 217, 210)) {
+		t.Errorf("applyTemplate() = %v, %v, %v", eth, ip, err)
+	}
+	if _, _, err := s.applyTemplate(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("applyTemplate() accepted an IPv6 target without IPv6 route")
+	}
+
+	s.src6 = local6
+	s.eth6, s.ip6 = createTemplate6(localHw, routerHw, local6)
+	eth, ip, err = s.applyTemplate(net.ParseIP("2001:db8::1"))
+	if err != nil || eth.EthernetType != layers.EthernetTypeIPv6 || ip.NetworkFlow().Dst() != layers.NewIPEndpoint(net.ParseIP("2001:db8::1")) {
+		t.Errorf("applyTemplate() = %v, %v, %v", eth, ip, err)
+	}
+	tcp := &layers.TCP{SrcPort: scannerSrcPort, DstPort: 1080, SYN: true}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	p := serialize(t, eth, ip, tcp)
+	if ip6, ok := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6); !ok || !ip6.SrcIP.Equal(local6) {
+		t.Errorf("applyTemplate() sent %v", p)
+	}
+}
+
+func Test_scanner_getHwAddr(t *testing.T) {
+	frame := arpFrame(t)
+	l := &fakeLink{frames: make(chan []byte, 1)}
+	l.frames <- frame
+	s := &scanner{
+		iface: &net.Interface{Name: "eth0", HardwareAddr: localHw},
+		src:   net.IPv4(10, 0, 0, 1),
+		link:  l,
+		buf:   gopacket.NewSerializeBuffer(),
+	}
+	hw, err := s.getHwAddr(net.IPv4(10, 0, 0, 254))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the link reuses the buffer for the next frames
+	for i := range frame {
+		frame[i] = 0xff
+	}
+	if hw.String() != routerHw.String() {
+		t.Errorf("getHwAddr() = %v after the buffer is reused, want %v", hw, routerHw)
+	}
+}
+
+func Test_scanner_enableIPv6OnLink(t *testing.T) {
+	iface := &net.Interface{Index: 1000, Name: "eth0"}
+	s := &scanner{iface: iface}
+	s.no6 = s.enableIPv6(fakeRouter{iface: iface, src: local6})
+	if s.no6 == nil || !strings.Contains(s.no6.Error(), "on the link") {
+		t.Fatalf("enableIPv6() = %v, want the on-link route rejected", s.no6)
+	}
+	if _, _, err := s.applyTemplate(net.ParseIP("2001:db8::1")); err == nil || !strings.Contains(err.Error(), "on the link") {
+		t.Errorf("applyTemplate() = %v, want the reason IPv6 is disabled", err)
+	}
+}
+
 func Benchmark_scanner_Probe(b *testing.B) {
 	s := create(b)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -58,12 +123,71 @@ func Benchmark_scanner_Probe(b *testing.B) {
 	<-done
 }
 
+// Benchmark_scanner_links compares the packets per second sent by the links over a veth pair
+func Benchmark_scanner_links(b *testing.B) {
+	tx, _ := veth(b)
+	links := []struct {
+		name string
+		open func() (link, error)
+	}{
+		{"pcap", func() (link, error) { return openPcap(tx, "tcp") }},
+		{"ring", func() (link, error) { return openRing(tx, nil) }},
+	}
+	dst := net.ParseIP("10.99.0.2")
+	for _, l := range links {
+		b.Run(l.name, func(b *testing.B) {
+			lnk, err := l.open()
+			if err != nil {
+				b.Skip(err)
+			}
+			defer lnk.close()
+			s := &scanner{
+				opts:        gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+				cookies:     testCookies,
+				tx:          testCookies.hash(),
+				buf:         gopacket.NewSerializeBuffer(),
+				link:        lnk,
+				tcpTemplate: createTemplate(tx.HardwareAddr, localHw, net.ParseIP("10.99.0.1").To4()),
+			}
+			b.ResetTimer()
+			start := time.Now()
+			for n := 0; n < b.N; n++ {
+				if err := s.Probe(dst, uint16(n)); err != nil {
+					b.Fatal(err, n)
+				}
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pps")
+		})
+	}
+}
+
+// veth creates a pair of connected interfaces, the test is skipped without the privileges
+func veth(t testing.TB) (*net.Interface, *net.Interface) {
+	name := fmt.Sprintf("uwt%d", os.Getpid()%10000)
+	if out, err := exec.Command("ip", "link", "add", name+"a", "type", "veth", "peer", "name", name+"b").CombinedOutput(); err != nil {
+		t.Skipf("can't create veth pair: %v %s", err, out)
+	}
+	t.Cleanup(func() { _ = exec.Command("ip", "link", "del", name+"a").Run() })
+	var ifaces []*net.Interface
+	for _, n := range []string{name + "a", name + "b"} {
+		if out, err := exec.Command("ip", "link", "set", n, "up").CombinedOutput(); err != nil {
+			t.Fatalf("can't bring %s up: %v %s", n, err, out)
+		}
+		iface, err := net.InterfaceByName(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces[0], ifaces[1]
+}
+
 func create(t testing.TB) *scanner {
 	r, err := router.New()
 	if err != nil {
 		t.Fatal(err)
 	}
-	s, err := NewScanner(net.IPv4(8, 8, 8, 8), r)
+	s, err := NewScanner(r, RouteOptions{Target: net.IPv4(8, 8, 8, 8)}, PortRange{First: scannerSrcPort, Last: scannerSrcPort})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"container/heap"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+	"uwalker/banner"
+	"uwalker/gen"
+	"uwalker/scan"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simClock is advanced by the test, the timers due at the same instant fire in the order they were scheduled
+type simClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int
+	timers simTimers
+	// poll is the timer of the last After, Transmit asks for it only when it's idle, polls counts the calls
+	poll  *simTimer
+	polls int
+}
+
+type simTimer struct {
+	clk *simClock
+	at  time.Time
+	seq int
+	// idx is the index in the heap, -1 once the timer is fired or stopped
+	idx int
+	f   func()
+	// ch is the channel of After
+	ch chan time.Time
+}
+
+func newSimClock() *simClock {
+	return &simClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *simClock) AfterFunc(d time.Duration, f func()) timer {
+	t := &simTimer{clk: c, idx: -1, f: f}
+	t.Reset(d)
+	return t
+}
+
+// After replaces the previous poll, Transmit forgets its channel whenever it asks for a new one
+func (c *simClock) After(d time.Duration) <-chan time.Time {
+	t := &simTimer{clk: c, idx: -1, ch: make(chan time.Time, 1)}
+	t.f = func() { t.ch <- t.at }
+	c.mu.Lock()
+	if c.poll != nil {
+		c.stop(c.poll)
+	}
+	c.poll = t
+	c.polls++
+	c.mu.Unlock()
+	t.Reset(d)
+	return t.ch
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	c := t.clk
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := c.stop(t)
+	t.at = c.now.Add(d)
+	t.seq = c.seq
+	c.seq++
+	heap.Push(&c.timers, t)
+	return active
+}
+
+func (t *simTimer) Stop() bool {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	return t.clk.stop(t)
+}
+
+func (c *simClock) stop(t *simTimer) bool {
+	if t.idx < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.idx)
+	return true
+}
+
+func (c *simClock) pollCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.polls
+}
+
+// next advances the clock to the earliest timer and removes it, nil if there are none
+func (c *simClock) next() *simTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return nil
+	}
+	t := heap.Pop(&c.timers).(*simTimer)
+	c.now = t.at
+	return t
+}
+
+type simTimers []*simTimer
+
+func (h simTimers) Len() int { return len(h) }
+
+func (h simTimers) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h simTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+
+func (h *simTimers) Push(x interface{}) {
+	t := x.(*simTimer)
+	t.idx = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *simTimers) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	t.idx = -1
+	return t
+}
+
+type simKind int
+
+const (
+	closedPort simKind = iota
+	silentHost
+	socks5None
+	socks5Password
+	// slowReply acks the greeting at once and replies after the slowDelay, tooSlowReply after the conductor gives up
+	slowReply
+	tooSlowReply
+	// synLoss loses the first SYN, dataLoss the first segment of the greeting
+	synLoss
+	dataLoss
+	// reordered replies in two segments arriving in the reverse order
+	reordered
+	simKinds
+)
+
+const (
+	simISN       = 7000
+	slowDelay    = 3 * time.Second
+	tooSlowDelay = 30 * time.Second
+)
+
+type simHost struct {
+	ip      net.IP
+	kind    simKind
+	latency time.Duration
+
+	// recv is the sequence of the next byte expected from the conductor, seq of the next byte sent to it
+	recv, seq uint32
+	syns      int
+	segments  int
+}
+
+func (h *simHost) reply() []byte {
+	if h.kind == socks5None {
+		return []byte{5, 0}
+	}
+	return []byte{5, 2}
+}
+
+// simNet is a Sender delivering the answers of the virtual hosts on the simulated clock
+type simNet struct {
+	clk     *simClock
+	packets chan []*scan.Packet
+	// barrier gets the count of the polls when the conductor resets the connection to the barrierIP,
+	// done is closed once Transmit returns
+	barrier chan int
+	done    chan struct{}
+
+	mu    sync.Mutex
+	hosts map[string]*simHost
+	// stopped drops the packets delivered after the packets are closed, peak is the most connections in flight
+	// after a step, both are used by the stepping routine only
+	stopped bool
+	peak    int
+}
+
+// barrierIP is sent the packets of an unknown connection, the conductor resets it after the requests queued before
+var barrierIP = net.IPv4(192, 0, 2, 1)
+
+func newSimNet(clk *simClock, hosts []*simHost) *simNet {
+	s := &simNet{
+		clk:     clk,
+		packets: make(chan []*scan.Packet),
+		barrier: make(chan int),
+		done:    make(chan struct{}),
+		hosts:   make(map[string]*simHost),
+	}
+	for _, h := range hosts {
+		s.hosts[h.ip.String()] = h
+	}
+	return s
+}
+
+func (s *simNet) Probe(dst net.IP, port uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.hosts[dst.String()]
+	h.syns++
+	switch {
+	case h.kind == silentHost, h.kind == synLoss && h.syns == 1:
+		return nil
+	case h.kind == closedPort:
+		s.deliver(2*h.latency, &scan.Packet{Addr: h.ip, Port: port, Done: true, Ack: 1})
+		return nil
+	}
+	h.recv, h.seq = 1, simISN+1
+	s.deliver(2*h.latency, &scan.Packet{Addr: h.ip, Port: port, Start: true, Seq: simISN, Ack: 1})
+	return nil
+}
+
+func (s *simNet) ProbeData(dst net.IP, port uint16, seq, ack uint32, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.hosts[dst.String()]
+	if len(data) == 0 || seq != h.recv {
+		return nil // acks and duplicates need no answer
+	}
+	h.segments++
+	if h.kind == dataLoss && h.segments == 1 {
+		return nil
+	}
+	h.recv += uint32(len(data))
+	reply := h.reply()
+	switch h.kind {
+	case slowReply, tooSlowReply:
+		delay := slowDelay
+		if h.kind == tooSlowReply {
+			delay = tooSlowDelay
+		}
+		s.deliver(2*h.latency, s.segment(h, port, nil))
+		s.deliver(2*h.latency+delay, s.segment(h, port, reply))
+	case reordered:
+		first, second := s.segment(h, port, reply[:1]), s.segment(h, port, reply[1:])
+		s.deliver(2*h.latency, second)
+		s.deliver(2*h.latency, first)
+	default:
+		s.deliver(2*h.latency, s.segment(h, port, reply))
+	}
+	return nil
+}
+
+func (s *simNet) Terminate(dst net.IP, port uint16, seq uint32) error {
+	if dst.Equal(barrierIP) {
+		s.barrier <- s.clk.pollCount()
+	}
+	return nil
+}
+
+func (s *simNet) segment(h *simHost, port uint16, data []byte) *scan.Packet {
+	p := &scan.Packet{Addr: h.ip, Port: port, Seq: h.seq, Ack: h.recv, Data: data}
+	h.seq += uint32(len(data))
+	return p
+}
+
+func (s *simNet) deliver(d time.Duration, p *scan.Packet) {
+	s.clk.AfterFunc(d, func() {
+		if !s.stopped {
+			s.packets <- []*scan.Packet{p}
+		}
+	})
+}
+
+// step fires the earliest timer and waits for the conductor to handle it, false if there are no timers
+func (s *simNet) step(c *Conductor) bool {
+	t := s.clk.next()
+	if t == nil {
+		return false
+	}
+	t.f()
+	if t.ch != nil {
+		for len(t.ch) > 0 && !closed(s.done) {
+			runtime.Gosched() // the poll is received unless Transmit is finished
+		}
+	}
+	if !s.stopped {
+		s.settle(c)
+	}
+	return true
+}
+
+// settle waits for Collect to handle the delivered packets and for Transmit to send the requests queued meanwhile
+// and to wait for the next poll, the clock must not be advanced before Transmit asks for it
+func (s *simNet) settle(c *Conductor) {
+	s.packets <- []*scan.Packet{{Addr: barrierIP, Port: 1, Ack: 1}}
+	select {
+	case polls := <-s.barrier:
+		for s.clk.pollCount() == polls && !closed(s.done) {
+			runtime.Gosched()
+		}
+		st := c.Stats()
+		if n := int(st.Open + st.HalfOpen); n > s.peak {
+			s.peak = n
+		}
+	case <-s.done:
+	}
+}
+
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// simulate probes the hosts until the simulated end, it returns the detected protocols by address
+func simulate(hosts []*simHost, port uint16, maxInFlight int, end time.Duration) (*simNet, *Conductor, map[string]Protocol) {
+	clk := newSimClock()
+	sim := newSimNet(clk, hosts)
+	c := NewConductor(sim, noLimit{}, Detectors{
+		Default: []Detector{func() ConnectionState { return &banner.Socks5{} }},
+	}, defaultRecovery, maxInFlight)
+	c.clock = clk
+
+	got := make(map[string]Protocol)
+	established := c.Collect(sim.packets)
+	collected := make(chan struct{})
+	go func() {
+		for p := range established {
+			got[p.Ip.String()] = p
+		}
+		close(collected)
+	}()
+	targets := make(chan gen.Target, len(hosts))
+	for _, h := range hosts {
+		targets <- gen.Target{IP: h.ip, Port: port}
+	}
+	close(targets)
+	go func() {
+		_ = c.Transmit(targets)
+		close(sim.done)
+	}()
+	sim.settle(c)
+
+	for stop := clk.Now().Add(end); clk.Now().Before(stop) && sim.step(c); {
+	}
+	sim.stopped = true
+	close(sim.packets)
+	<-collected
+	for !closed(sim.done) {
+		if !sim.step(c) {
+			runtime.Gosched()
+		}
+	}
+	return sim, c, got
+}
+
+func TestConductor_simulated(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const port = 1080
+	hosts := make([]*simHost, 4096)
+	for i := range hosts {
+		hosts[i] = &simHost{
+			ip:      net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4(),
+			kind:    simKind(i % int(simKinds)),
+			latency: time.Duration(10+i%7*15) * time.Millisecond,
+		}
+	}
+	want := make(map[string]Protocol)
+	var st Stats
+	for _, h := range hosts {
+		rtt := 2 * h.latency
+		switch h.kind {
+		case closedPort, tooSlowReply:
+			continue
+		case silentHost:
+			st.SynRetries += 2
+			continue
+		case slowReply:
+			rtt += slowDelay
+		case synLoss:
+			st.SynRetries++
+			st.SynRetryHits++
+		case dataLoss:
+			rtt += defaultRecovery.RTO
+			st.Retransmissions++
+			st.RetransmitHits++
+		}
+		st.Hits++
+		auth := "password"
+		if h.kind == socks5None {
+			auth = "none"
+		}
+		want[h.ip.String()] = Protocol{h.ip, port, banner.Result{
+			Proto: "socks5", Version: "5", Auth: []string{auth}, Response: h.reply(), RTT: rtt,
+		}}
+	}
+
+	for _, tt := range []struct {
+		name        string
+		maxInFlight int
+		end         time.Duration
+	}{
+		{"unbounded", 0, time.Minute},
+		// the table is filled by the silent and slow hosts, the SYNs are paused then
+		{"bounded", 256, 5 * time.Minute},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, h := range hosts {
+				h.syns, h.segments = 0, 0
+			}
+			sim, c, got := simulate(hosts, port, tt.maxInFlight, tt.end)
+			assert.Equal(t, want, got)
+			assert.Equal(t, st, c.Stats())
+			if tt.maxInFlight > 0 {
+				assert.Equal(t, tt.maxInFlight, sim.peak)
+			}
+		})
+	}
+}
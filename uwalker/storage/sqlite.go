@@ -2,24 +2,61 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"net"
+	"strings"
 	"time"
+	"uwalker/banner"
 )
 
 var createStmt = `
 	create table if not exists banners(
 	    id integer primary key autoincrement ,
-		ip varchar(32) not null,
+		ip varchar(45) not null,
 		port varchar(4) not null,
 		proto varchar(10) not null,
-		added timestamp not null
+		added timestamp not null,
+		meta text,
+		auth varchar(16),
+		version varchar(8),
+		server text,
+		response blob,
+		rtt integer
 );
+	create table if not exists scan_checkpoints(
+		scan_id varchar(64) primary key,
+		targets text not null,
+		ports text not null,
+		position integer not null,
+		done boolean not null,
+		updated timestamp not null
+);
+`
+
+// migrations update tables created by the previous versions, they must be idempotent
+var migrations = []string{
+	`alter table banners add column meta text;`,
+	`alter table banners add column auth varchar(16);`,
+	`alter table banners add column version varchar(8);`,
+	`alter table banners add column server text;`,
+	`alter table banners add column response blob;`,
+	`alter table banners add column rtt integer;`,
+}
+
+var saveCheckpointStmt = `
+	insert or replace into scan_checkpoints(scan_id, targets, ports, position, done, updated)
+	values (?, ?, ?, ?, ?, ?);
+`
+
+var loadCheckpointStmt = `
+	select targets, ports, position, done, updated from scan_checkpoints where scan_id = ?;
 `
 
 var addStmt = `
-	insert into banners(ip, port, proto, added) values (?, ?, ?, ?);
+	insert into banners(ip, port, proto, added, meta, auth, version, server, response, rtt)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 `
 
 type Sqlite struct {
@@ -34,18 +71,64 @@ func NewSqlite(path string) (*Sqlite, error) {
 	return &Sqlite{db: db}, nil
 }
 
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
 func (s *Sqlite) prepare() error {
 	_, err := s.db.Exec(createStmt)
 	if err != nil {
 		return errors.Wrap(err, "failed to create tables")
 	}
+	for _, m := range migrations {
+		_, err := s.db.Exec(m)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return errors.Wrap(err, "failed to migrate tables")
+		}
+	}
 	return nil
 }
 
-func (s *Sqlite) SaveBanner(ip net.IP, port uint16, proto string) error {
-	_, err := s.db.Exec(addStmt, ip.String(), port, proto, time.Now().Unix())
+// SaveBanner saves the detected proxy. The metadata is stored as a JSON object,
+// the authentication methods are comma separated and the rtt is in microseconds.
+func (s *Sqlite) SaveBanner(ip net.IP, port uint16, r banner.Result) error {
+	var meta sql.NullString
+	if len(r.Meta) > 0 {
+		b, err := json.Marshal(r.Meta)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode metadata")
+		}
+		meta = sql.NullString{String: string(b), Valid: true}
+	}
+	_, err := s.db.Exec(addStmt, ip.String(), port, r.Proto, time.Now().Unix(), meta,
+		nullString(strings.Join(r.Auth, ",")), nullString(r.Version), nullString(r.Server),
+		r.Response, r.RTT.Microseconds())
 	if err != nil {
 		return errors.Wrap(err, "failed to insert new data")
 	}
 	return nil
 }
+
+func (s *Sqlite) SaveCheckpoint(c Checkpoint) error {
+	_, err := s.db.Exec(saveCheckpointStmt, c.ScanID, c.Targets, c.Ports, int64(c.Position), c.Done, c.Updated.Unix())
+	if err != nil {
+		return errors.Wrap(err, "failed to save the checkpoint")
+	}
+	return nil
+}
+
+func (s *Sqlite) LoadCheckpoint(scanID string) (*Checkpoint, error) {
+	c := &Checkpoint{ScanID: scanID}
+	var position int64
+	var updated time.Time // the driver converts the unix time of timestamp columns
+	err := s.db.QueryRow(loadCheckpointStmt, scanID).Scan(&c.Targets, &c.Ports, &position, &c.Done, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the checkpoint")
+	}
+	c.Position = uint64(position)
+	c.Updated = updated.Local()
+	return c, nil
+}
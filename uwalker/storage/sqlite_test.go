@@ -6,6 +6,8 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
+	"uwalker/banner"
 
 	"github.com/stretchr/testify/require"
 )
@@ -55,7 +57,7 @@ func TestSqlite_SaveBanner(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run("save banner", func(t *testing.T) {
-			if err := s.SaveBanner(tt.ip, tt.port, tt.proto); err != nil {
+			if err := s.SaveBanner(tt.ip, tt.port, banner.Result{Proto: tt.proto}); err != nil {
 				t.Errorf("SaveBanner() error")
 			}
 		})
@@ -84,7 +86,7 @@ func TestSqlite_ConcurrentReadOnly(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		err := s.SaveBanner(tt.ip, tt.port, tt.proto)
+		err := s.SaveBanner(tt.ip, tt.port, banner.Result{Proto: tt.proto})
 		require.NoError(t, err)
 	}
 
@@ -110,9 +112,76 @@ func TestSqlite_prepare(t *testing.T) {
 	_, err = s.db.Exec("select * from banners;")
 }
 
+func TestSqlite_migrate(t *testing.T) {
+	s := prep(t)
+	_, err := s.db.Exec(`create table banners(
+		id integer primary key autoincrement,
+		ip varchar(32) not null,
+		port varchar(4) not null,
+		proto varchar(10) not null,
+		added timestamp not null
+	);`)
+	require.NoError(t, err)
+	require.NoError(t, s.prepare())
+	require.NoError(t, s.prepare())
+
+	require.NoError(t, s.SaveBanner(net.ParseIP("10.0.0.1"), 3128, banner.Result{
+		Proto:    "http",
+		Version:  "1.1",
+		Auth:     []string{"basic", "ntlm"},
+		Server:   "squid",
+		Meta:     map[string]string{"via": "1.1 squid"},
+		Response: []byte("HTTP/1.1 407"),
+		RTT:      1500 * time.Microsecond,
+	}))
+	require.NoError(t, s.SaveBanner(net.ParseIP("10.0.0.2"), 1080, banner.Result{Proto: "socks5"}))
+
+	var meta, auth, version, server sql.NullString
+	var response []byte
+	var rtt int64
+	row := s.db.QueryRow("select meta, auth, version, server, response, rtt from banners where port = 3128")
+	require.NoError(t, row.Scan(&meta, &auth, &version, &server, &response, &rtt))
+	assert.Equal(t, `{"via":"1.1 squid"}`, meta.String)
+	assert.Equal(t, "basic,ntlm", auth.String)
+	assert.Equal(t, "1.1", version.String)
+	assert.Equal(t, "squid", server.String)
+	assert.Equal(t, []byte("HTTP/1.1 407"), response)
+	assert.Equal(t, int64(1500), rtt)
+
+	row = s.db.QueryRow("select meta, auth, version, server from banners where port = 1080")
+	require.NoError(t, row.Scan(&meta, &auth, &version, &server))
+	assert.False(t, meta.Valid || auth.Valid || version.Valid || server.Valid)
+}
+
 func prep(t *testing.T) *Sqlite {
 	_ = os.Remove(dbPath)
 	s, err := NewSqlite(dbPath)
 	require.NoError(t, err)
 	return s
 }
+
+func TestSqlite_Checkpoint(t *testing.T) {
+	s := prep(t)
+	require.NoError(t, s.prepare())
+
+	c, err := s.LoadCheckpoint("s1")
+	require.NoError(t, err)
+	assert.Nil(t, c)
+
+	want := Checkpoint{
+		ScanID:   "s1",
+		Targets:  "10.0.0.0/8",
+		Ports:    "1080",
+		Position: 1 << 40,
+		Updated:  time.Unix(1600000000, 0),
+	}
+	require.NoError(t, s.SaveCheckpoint(want))
+	want.Position++
+	want.Done = true
+	require.NoError(t, s.SaveCheckpoint(want))
+	require.NoError(t, s.SaveCheckpoint(Checkpoint{ScanID: "s2", Updated: time.Unix(1600000000, 0)}))
+
+	c, err = s.LoadCheckpoint("s1")
+	require.NoError(t, err)
+	assert.Equal(t, &want, c)
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"github.com/pkg/errors"
 	"net"
+	"time"
+	"uwalker/banner"
 )
 
 type preparer interface {
@@ -11,10 +13,24 @@ type preparer interface {
 }
 
 type Engine interface {
-	SaveBanner(ip net.IP, port uint16, proto string) error
+	SaveBanner(ip net.IP, port uint16, r banner.Result) error
+	SaveCheckpoint(c Checkpoint) error
+	// LoadCheckpoint returns nil if there is no checkpoint of the scan
+	LoadCheckpoint(scanID string) (*Checkpoint, error)
 	preparer
 }
 
+// Checkpoint is the progress of a scan: the index of the last scanned target in the order of the scan.
+// The scan parameters are kept for humans, the scan id is derived from them.
+type Checkpoint struct {
+	ScanID   string
+	Targets  string
+	Ports    string
+	Position uint64
+	Done     bool
+	Updated  time.Time
+}
+
 type Store struct {
 	engine Engine
 }
@@ -27,6 +43,14 @@ func NewStore(engine Engine) (*Store, error) {
 	return &Store{engine}, nil
 }
 
-func (s *Store) PersistBanner(ip net.IP, port uint16, proto string) error {
-	return s.engine.SaveBanner(ip, port, proto)
+func (s *Store) PersistBanner(ip net.IP, port uint16, r banner.Result) error {
+	return s.engine.SaveBanner(ip, port, r)
+}
+
+func (s *Store) SaveCheckpoint(c Checkpoint) error {
+	return s.engine.SaveCheckpoint(c)
+}
+
+func (s *Store) LoadCheckpoint(scanID string) (*Checkpoint, error) {
+	return s.engine.LoadCheckpoint(scanID)
 }
@@ -0,0 +1,63 @@
+package main
+
+// maxBuffered bounds the received bytes of a connection kept until its state consumes them
+const maxBuffered = 16 << 10
+
+// segment is received after a gap in the stream
+type segment struct {
+	seq  uint32
+	data []byte
+}
+
+// stream reassembles the received segments into the contiguous bytes the state hasn't consumed yet
+type stream struct {
+	// next is the sequence of the byte after buf
+	next uint32
+	buf  []byte
+	// pending are the segments after a gap ordered by their sequence, they may overlap
+	pending []segment
+	// size is the number of the buffered bytes including the pending ones
+	size int
+}
+
+// add buffers the bytes of the segment that aren't received yet. It returns whether the contiguous bytes grew,
+// ok is false once the buffer overflows.
+func (s *stream) add(seq uint32, data []byte) (grew, ok bool) {
+	if int32(seq-s.next) > 0 {
+		i := len(s.pending)
+		for i > 0 && int32(s.pending[i-1].seq-seq) > 0 {
+			i--
+		}
+		s.pending = append(s.pending, segment{})
+		copy(s.pending[i+1:], s.pending[i:])
+		s.pending[i] = segment{seq, data}
+		s.size += len(data)
+		return false, s.size <= maxBuffered
+	}
+	grew = s.append(seq, data)
+	for len(s.pending) > 0 && int32(s.pending[0].seq-s.next) <= 0 {
+		p := s.pending[0]
+		s.pending = s.pending[1:]
+		s.size -= len(p.data)
+		s.append(p.seq, p.data)
+	}
+	return grew, s.size <= maxBuffered
+}
+
+// append adds the bytes of the segment starting at or before next that follow next
+func (s *stream) append(seq uint32, data []byte) bool {
+	skip := int(s.next - seq)
+	if skip >= len(data) {
+		return false // received already
+	}
+	s.buf = append(s.buf, data[skip:]...)
+	s.next += uint32(len(data) - skip)
+	s.size += len(data) - skip
+	return true
+}
+
+// consume drops the first n contiguous bytes
+func (s *stream) consume(n int) {
+	s.buf = s.buf[n:]
+	s.size -= n
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_stream(t *testing.T) {
+	// the sequence wraps around in the middle of the stream
+	start := uint32(1<<32 - 4)
+	s := &stream{next: start}
+	add := func(off int, data string) (bool, bool) {
+		return s.add(start+uint32(off), []byte(data))
+	}
+
+	grew, ok := add(6, "ghi")
+	assert.False(t, grew)
+	assert.True(t, ok)
+	grew, _ = add(3, "def")
+	assert.False(t, grew)
+	assert.Empty(t, s.buf)
+
+	grew, ok = add(0, "abcd")
+	assert.True(t, grew)
+	assert.True(t, ok)
+	assert.Equal(t, "abcdefghi", string(s.buf))
+	assert.Equal(t, start+9, s.next)
+	assert.Empty(t, s.pending)
+
+	// the consumed and the buffered bytes are received already
+	s.consume(5)
+	grew, _ = add(0, "abcdefg")
+	assert.False(t, grew)
+	grew, _ = add(8, "ijk")
+	assert.True(t, grew)
+	assert.Equal(t, "fghijk", string(s.buf))
+	assert.Equal(t, 6, s.size)
+
+	_, ok = add(11, string(make([]byte, maxBuffered)))
+	assert.False(t, ok)
+}
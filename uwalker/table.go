@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// occupied returns the number of the open connections and the SYNs awaiting an answer
+func (c *Conductor) occupied() int {
+	return int(atomic.LoadUint64(&c.stats.Open)) + c.probes.len()
+}
+
+// full tells whether the table has no room for another connection
+func (c *Conductor) full() bool {
+	return c.maxInFlight > 0 && c.occupied() >= c.maxInFlight
+}
+
+// paused tells whether no more SYNs should be sent, either the table is full or the sender is busy
+func (c *Conductor) paused() bool {
+	return c.full() || c.busy()
+}
+
+// busy tells whether the sender has no room for another SYN
+func (c *Conductor) busy() bool {
+	b, ok := c.s.(Bounded)
+	return ok && b.Busy()
+}
+
+// wait handles a queued request or resends the due SYNs once the poll expires, the requests free the table
+func (c *Conductor) wait() {
+	select {
+	case req := <-c.txQ:
+		c.transmit(req)
+	case now := <-c.clock.After(retryPoll):
+		c.resend(now)
+	}
+}
+
+// remove deletes the connection from the table and stops its timers, it returns nil if there's no connection
+func (c *Conductor) remove(k connectionKey) *connection {
+	conn, ok := c.connections[k]
+	if !ok {
+		return nil
+	}
+	delete(c.connections, k)
+	c.lru.Remove(conn.elem)
+	atomic.AddUint64(&c.stats.Open, ^uint64(0))
+	conn.cancelTimer.Stop()
+	if conn.rtoTimer != nil {
+		conn.rtoTimer.Stop()
+	}
+	return conn
+}
+
+// makeRoom resets the oldest idle connections while the table is full.
+// The connections unknown to the table, e.g the answers to the SYNs given up on, take the place of the idle ones.
+func (c *Conductor) makeRoom() {
+	for c.full() && c.lru.Len() > 0 {
+		conn := c.lru.Back().Value.(*connection)
+		c.remove(connectionKey{conn.addr.String(), conn.port})
+		atomic.AddUint64(&c.stats.Evicted, 1)
+		c.enqueue(&txReq{seq: conn.seq, term: true, addr: conn.addr, port: conn.port})
+	}
+}
+
+// tableInterval is how often the occupancy of the connection table is logged
+const tableInterval = time.Minute
+
+// logTable logs the occupancy of the connection table until the ctx is done
+func logTable(ctx context.Context, c *Conductor) {
+	t := time.NewTicker(tableInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			st := c.Stats()
+			log.Printf("connection table: %d open, %d half-open, %d evicted, max in flight %d",
+				st.Open, st.HalfOpen, st.Evicted, c.maxInFlight)
+		}
+	}
+}
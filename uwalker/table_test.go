@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"uwalker/gen"
+	"uwalker/scan"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConductor_backpressure(t *testing.T) {
+	for name, recovery := range map[string]Recovery{
+		"retries":    {SynRetries: 1, SynBackoff: time.Minute},
+		"no retries": {SynBackoff: time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := &fakeSender{sent: make(chan sent, 10)}
+			c := NewConductor(s, noLimit{}, Detectors{Default: []Detector{detector("a", "hi a", "ok a")}}, recovery, 1)
+			packets := make(chan []*scan.Packet)
+			c.Collect(packets)
+			targets := make(chan gen.Target, 2)
+			targets <- gen.Target{IP: net.IPv4(10, 0, 0, 1), Port: 1080}
+			targets <- gen.Target{IP: net.IPv4(10, 0, 0, 2), Port: 1080}
+			close(targets)
+			go func() { _ = c.Transmit(targets) }()
+
+			assert.Equal(t, "syn", next(t, s).op)
+			select {
+			case p := <-s.sent:
+				assert.Fail(t, "the SYN awaiting an answer fills the table", "%v", p)
+			case <-time.After(100 * time.Millisecond):
+			}
+			assert.Equal(t, uint64(1), c.Stats().HalfOpen)
+			// the port is closed, the table has room again
+			packets <- []*scan.Packet{{Addr: net.IPv4(10, 0, 0, 1), Port: 1080, Done: true, Ack: 1}}
+			assert.Equal(t, sent{op: "rst", seq: 1}, next(t, s))
+			assert.Equal(t, "syn", next(t, s).op)
+			close(packets)
+		})
+	}
+}
+
+func TestConductor_evict(t *testing.T) {
+	s := &fakeSender{sent: make(chan sent, 10)}
+	c := NewConductor(s, noLimit{}, Detectors{Default: []Detector{detector("a", "hi a", "ok a")}}, Recovery{}, 2)
+	packets := make(chan []*scan.Packet)
+	c.Collect(packets)
+	targets := make(chan gen.Target)
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+
+	for i := byte(1); i <= 2; i++ {
+		packets <- []*scan.Packet{{Addr: net.IPv4(10, 0, 0, i), Port: 1080, Start: true, Seq: 100, Ack: 1}}
+		assert.Equal(t, sent{op: "data", seq: 1, data: []byte("hi a")}, next(t, s))
+	}
+	// the first connection becomes the most recently active one
+	packets <- []*scan.Packet{{Addr: net.IPv4(10, 0, 0, 1), Port: 1080, Seq: 101, Ack: 5}}
+	packets <- []*scan.Packet{{Addr: net.IPv4(10, 0, 0, 3), Port: 1080, Start: true, Seq: 100, Ack: 1}}
+	// the second one is the oldest idle, it is reset to make room for the third one
+	assert.Equal(t, sent{op: "rst", seq: 1}, next(t, s))
+	assert.Equal(t, sent{op: "data", seq: 1, data: []byte("hi a")}, next(t, s))
+	packets <- []*scan.Packet{{Addr: net.IPv4(10, 0, 0, 2), Port: 1080, Seq: 101, Ack: 5, Data: []byte("ok a")}}
+	assert.Equal(t, sent{op: "rst", seq: 5}, next(t, s))
+	st := c.Stats()
+	assert.Equal(t, uint64(1), st.Evicted)
+	assert.Equal(t, uint64(2), st.Open)
+	close(packets)
+}
+
+// busySender is busy until free is set
+type busySender struct {
+	fakeSender
+	free int32
+}
+
+func (s *busySender) Busy() bool {
+	return atomic.LoadInt32(&s.free) == 0
+}
+
+func TestConductor_busySender(t *testing.T) {
+	s := &busySender{fakeSender: fakeSender{sent: make(chan sent, 10)}}
+	c := NewConductor(s, noLimit{}, Detectors{Default: []Detector{detector("a", "hi a", "ok a")}}, Recovery{}, 0)
+	packets := make(chan []*scan.Packet)
+	c.Collect(packets)
+	targets := make(chan gen.Target, 1)
+	targets <- gen.Target{IP: net.IPv4(10, 0, 0, 2), Port: 1080}
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+
+	// the connection established before is served while the SYN waits for room
+	packets <- []*scan.Packet{{Addr: net.IPv4(10, 0, 0, 1), Port: 1080, Start: true, Seq: 100, Ack: 1}}
+	assert.Equal(t, sent{op: "data", seq: 1, data: []byte("hi a")}, next(t, &s.fakeSender))
+	atomic.StoreInt32(&s.free, 1)
+	assert.Equal(t, "syn", next(t, &s.fakeSender).op)
+	close(packets)
+}
+
+func TestConductor_busySenderNoEviction(t *testing.T) {
+	s := &busySender{fakeSender: fakeSender{sent: make(chan sent, 10)}}
+	c := NewConductor(s, noLimit{}, Detectors{Default: []Detector{detector("a", "hi a", "ok a")}}, Recovery{}, 0)
+	packets := make(chan []*scan.Packet)
+	c.Collect(packets)
+	targets := make(chan gen.Target)
+	close(targets)
+	go func() { _ = c.Transmit(targets) }()
+
+	// the busy sender pauses the SYNs only, the established connections stay in the table
+	for i := byte(1); i <= 3; i++ {
+		packets <- []*scan.Packet{{Addr: net.IPv4(10, 0, 0, i), Port: 1080, Start: true, Seq: 100, Ack: 1}}
+		assert.Equal(t, sent{op: "data", seq: 1, data: []byte("hi a")}, next(t, &s.fakeSender))
+	}
+	st := c.Stats()
+	assert.Equal(t, uint64(0), st.Evicted)
+	assert.Equal(t, uint64(3), st.Open)
+	close(packets)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+	"uwalker/gen"
+	"uwalker/report"
+	"uwalker/scan"
+	"uwalker/storage"
+)
+
+const (
+	// idlePoll is how often ursus is asked for work when the job queue is empty
+	idlePoll   = 5 * time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Backend sends probes and delivers the received packets
+type Backend interface {
+	Sender
+	Packets(ctx context.Context) <-chan []*scan.Packet
+}
+
+// work scans shards dispatched by ursus until ctx is done
+func work(ctx context.Context, b Backend, detectors Detectors, excludes []string, store *storage.Store, reporter *report.Reporter) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		shard, err := reporter.NextShard(ctx)
+		if invalid, ok := err.(*report.InvalidShardError); ok && invalid.ID != "" {
+			// it would fail on any walker, it is completed to leave the queue
+			log.Printf("failed to decode shard %s: %v", invalid.ID, invalid)
+			complete(ctx, reporter, invalid.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("failed to get a shard from ursus: %v, retrying in %s", err, backoff)
+			sleep(ctx, backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		if shard == nil {
+			sleep(ctx, idlePoll)
+			continue
+		}
+		log.Printf("scanning shard %s of %s: %s, ports %s", shard.ID, shard.Scan, strings.Join(shard.Targets, ","), shard.Ports)
+		if err := scanShard(ctx, b, shard, detectors, excludes, store, reporter); err != nil {
+			// an invalid shard would fail on any walker, it is completed to leave the queue
+			log.Printf("failed to scan shard %s: %v", shard.ID, err)
+		}
+		if ctx.Err() != nil {
+			// ursus returns the shard to the queue after the walker disconnects
+			return
+		}
+		complete(ctx, reporter, shard.ID)
+	}
+}
+
+// complete tells ursus the shard is done until it's acknowledged or ctx is done
+func complete(ctx context.Context, reporter *report.Reporter, id string) {
+	for {
+		err := reporter.ShardDone(ctx, id)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Printf("failed to complete shard %s: %v", id, err)
+		sleep(ctx, time.Second)
+	}
+}
+
+func scanShard(ctx context.Context, b Backend, shard *report.Shard, detectors Detectors, excludes []string, store *storage.Store, reporter *report.Reporter) error {
+	ports, err := parsePorts(shard.Ports)
+	if err != nil {
+		return err
+	}
+	g, err := gen.NewGenerator(shard.Targets, excludes, seed(shard.ID, 0))
+	if err != nil {
+		return err
+	}
+	reporter.SetScan(report.Scan{
+		ID:      shard.Scan,
+		Targets: strings.Join(shard.Targets, ","),
+		Ports:   shard.Ports,
+		Rate:    shard.Rate,
+	})
+	run(ctx, b, g, ports, detectors, shard.Rate, store, reporter)
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}